@@ -0,0 +1,243 @@
+/*
+Admin pages, only reachable by accounts listed in -admin-accounts
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	entrytaskproto "git.garena.com/wilber.chaowb/yanfeng-entry-task/protobuf_files/entry-task-proto"
+	"google.golang.org/protobuf/proto"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var adminAccounts = flag.String("admin-accounts", "admin", "comma separated list of accounts allowed to use the admin pages")
+
+// adminPage is what admin.gtpl renders
+type adminPage struct {
+	Account   string
+	Message   string
+	CSRFToken string
+}
+
+func isAdmin(account string) bool {
+	for _, admin := range strings.Split(*adminAccounts, ",") {
+		if strings.TrimSpace(admin) == account {
+			return true
+		}
+	}
+	return false
+}
+
+func renderAdmin(w http.ResponseWriter, page adminPage) {
+	t, err := template.ParseFiles("HTML_Pages/admin.gtpl")
+	if err != nil {
+		log.Println("error parsing admin template: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	t.ExecuteTemplate(w, "admin", page)
+}
+
+func admin(w http.ResponseWriter, r *http.Request) {
+	log.Println("Method for admin: ", r.Method) //get request method
+	renderAdmin(w, adminPage{Account: authenticatedUser(r).Account, CSRFToken: csrfToken(r)})
+}
+
+// adminRevokeSessions logs an account out everywhere by revoking every token issued to it so far
+func adminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	log.Println("Method for adminRevokeSessions: ", r.Method) //get request method
+	account := authenticatedUser(r).Account
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return
+	}
+	r.ParseForm()
+	target := strings.TrimSpace(r.FormValue("account"))
+	if target == "" {
+		renderAdmin(w, adminPage{Account: account, Message: "account is required", CSRFToken: csrfToken(r)})
+		return
+	}
+	revokeSessionsProto := &entrytaskproto.RevokeSessions{
+		Account:    target,
+		TtlSeconds: int64(TokenLifetime.Seconds()),
+		Actor:      account,
+	}
+	payload, err := proto.Marshal(revokeSessionsProto)
+	if err != nil {
+		log.Fatal("error marshalling revokeSessionsProto", err)
+	}
+	buffer := sendPayloadAndReceiveBuffer(6, payload) // 6 for revoke every session of an account
+	response := &entrytaskproto.Response{}
+	if err := proto.Unmarshal(buffer, response); err != nil {
+		log.Fatalln("Failed to parse reply from TCP: ", err)
+	}
+	if response.GetStatus() != 1 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s revoked every session of %s\n", account, target)
+	renderAdmin(w, adminPage{Account: account, Message: "revoked every session of " + target, CSRFToken: csrfToken(r)})
+}
+
+// accountStatusActions are what the admin page can do to an account, and the status each one sets
+var accountStatusActions = map[string]string{
+	"deactivate": "disabled",
+	"reactivate": "active",
+	"delete":     "deleted",
+}
+
+// adminSetAccountStatus deactivates, reactivates or deletes an account,
+// anything but reactivating also logs it out everywhere
+func adminSetAccountStatus(w http.ResponseWriter, r *http.Request) {
+	log.Println("Method for adminSetAccountStatus: ", r.Method) //get request method
+	account := authenticatedUser(r).Account
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return
+	}
+	r.ParseForm()
+	target := strings.TrimSpace(r.FormValue("account"))
+	action := r.FormValue("action")
+	status, ok := accountStatusActions[action]
+	if target == "" || !ok {
+		renderAdmin(w, adminPage{Account: account, Message: "account and action are required", CSRFToken: csrfToken(r)})
+		return
+	}
+	if target == account && status != "active" {
+		renderAdmin(w, adminPage{Account: account, Message: "you cannot " + action + " your own account", CSRFToken: csrfToken(r)})
+		return
+	}
+	setAccountStatusProto := &entrytaskproto.SetAccountStatus{
+		Account:    target,
+		Status:     status,
+		Actor:      account,
+		TtlSeconds: int64(TokenLifetime.Seconds()),
+	}
+	payload, err := proto.Marshal(setAccountStatusProto)
+	if err != nil {
+		log.Fatal("error marshalling setAccountStatusProto", err)
+	}
+	buffer := sendPayloadAndReceiveBuffer(12, payload) // 12 for change the status of an account
+	response := &entrytaskproto.Response{}
+	if err := proto.Unmarshal(buffer, response); err != nil {
+		log.Fatalln("Failed to parse reply from TCP: ", err)
+	}
+	if response.GetStatus() == 0 {
+		renderAdmin(w, adminPage{Account: account, Message: "no account " + target, CSRFToken: csrfToken(r)})
+		return
+	} else if response.GetStatus() != 1 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	renderAdmin(w, adminPage{Account: account, Message: target + " is now " + status, CSRFToken: csrfToken(r)})
+}
+
+// auditTimeLayout is what datetime-local inputs send, the audit page works in UTC
+const auditTimeLayout = "2006-01-02T15:04"
+
+// auditPage is what audit.gtpl renders
+type auditPage struct {
+	Account string // the admin looking
+	Filter  string // account searched for, empty for all
+	From    string
+	To      string
+	Events  []auditRow
+	Message string
+}
+
+type auditRow struct {
+	At       string
+	Account  string
+	Actor    string
+	Event    string
+	IP       string
+	OldValue string
+	NewValue string
+}
+
+// parseAuditTime reads a time from the audit page form, the zero time when empty
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.ParseInLocation(auditTimeLayout, value, time.UTC)
+	if err != nil {
+		return time.Time{}, errors.New("times look like " + auditTimeLayout + ", not " + value)
+	}
+	return parsed, nil
+}
+
+// adminAudit shows the audit log filtered by account and time range
+func adminAudit(w http.ResponseWriter, r *http.Request) {
+	log.Println("Method for adminAudit: ", r.Method) //get request method
+	page := auditPage{
+		Account: authenticatedUser(r).Account,
+		Filter:  strings.TrimSpace(r.FormValue("account")),
+		From:    r.FormValue("from"),
+		To:      r.FormValue("to"),
+	}
+	since, err := parseAuditTime(page.From)
+	if err == nil {
+		var until time.Time
+		until, err = parseAuditTime(page.To)
+		if err == nil && !until.IsZero() {
+			// include the whole minute picked
+			until = until.Add(time.Minute)
+		}
+		if err == nil {
+			page.Events, err = queryAuditLog(page.Filter, since, until)
+		}
+	}
+	if err != nil {
+		page.Message = err.Error()
+	}
+
+	t, err := template.ParseFiles("HTML_Pages/audit.gtpl")
+	if err != nil {
+		log.Println("error parsing audit template: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	t.ExecuteTemplate(w, "audit", page)
+}
+
+func queryAuditLog(account string, since time.Time, until time.Time) ([]auditRow, error) {
+	queryProto := &entrytaskproto.QueryAuditEvents{Account: account}
+	if !since.IsZero() {
+		queryProto.Since = since.Unix()
+	}
+	if !until.IsZero() {
+		queryProto.Until = until.Unix()
+	}
+	payload, err := proto.Marshal(queryProto)
+	if err != nil {
+		log.Fatal("error marshalling queryAuditEventsProto", err)
+	}
+	buffer := sendPayloadAndReceiveBuffer(11, payload) // 11 for query the audit log
+	reply := &entrytaskproto.AuditEvents{}
+	if err := proto.Unmarshal(buffer, reply); err != nil {
+		log.Fatalln("Failed to parse reply from TCP: ", err)
+	}
+	if reply.GetStatus() != 1 {
+		return nil, errors.New("could not read the audit log")
+	}
+	var rows []auditRow
+	for _, event := range reply.GetEvents() {
+		rows = append(rows, auditRow{
+			At:       time.UnixMilli(event.GetAt()).UTC().Format("2006-01-02 15:04:05.000"),
+			Account:  event.GetAccount(),
+			Actor:    event.GetActor(),
+			Event:    event.GetEvent(),
+			IP:       event.GetIp(),
+			OldValue: event.GetOldValue(),
+			NewValue: event.GetNewValue(),
+		})
+	}
+	return rows, nil
+}
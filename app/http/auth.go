@@ -0,0 +1,146 @@
+/*
+Authentication middleware, the JWT in the token cookie is validated once per request
+and the claims are handed to the handler through the request context
+*/
+
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	entrytaskproto "git.garena.com/wilber.chaowb/yanfeng-entry-task/protobuf_files/entry-task-proto"
+	"github.com/dgrijalva/jwt-go"
+	"google.golang.org/protobuf/proto"
+	"log"
+	"mime"
+	"net/http"
+)
+
+var (
+	errNoToken      = errors.New("no token")
+	errInvalidToken = errors.New("invalid token")
+	errRevokedToken = errors.New("revoked token")
+)
+
+type contextKey int
+
+const claimsContextKey contextKey = 0
+
+// authenticate parses and validates the token cookie of the request
+func authenticate(r *http.Request) (*Claims, error) {
+	claims, err := parseTokenCookie(r, "token")
+	if err != nil {
+		return nil, err
+	}
+	if claims.MFAPending {
+		// only good for the TOTP page
+		return nil, errInvalidToken
+	}
+	if isTokenRevoked(claims) {
+		// logged out or revoked by an admin so login again
+		return nil, errRevokedToken
+	}
+	return claims, nil
+}
+
+// parseTokenCookie checks the signature and expiry of the JWT in the named cookie
+func parseTokenCookie(r *http.Request, name string) (*Claims, error) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return nil, errNoToken
+	}
+
+	// Initialize a new instance of `Claims`
+	claims := &Claims{}
+
+	// Parse the JWT string and store the result in `claims`.
+	// Note that we are passing the key in this method as well. This method will return an error
+	// if the token is invalid (if it has expired according to the expiry time we set on sign in),
+	// or if the signature does not match
+	tkn, err := jwt.ParseWithClaims(c.Value, claims, func(token *jwt.Token) (interface{}, error) {
+		return secretKey, nil
+	})
+	if err != nil || !tkn.Valid {
+		return nil, errInvalidToken
+	}
+	return claims, nil
+}
+
+// requireAuth only lets requests with a valid token through to next.
+// Page loads and form posts are sent back to login, anything else gets a 401.
+func requireAuth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := authenticate(r)
+		if err != nil {
+			log.Println("unauthenticated request to", r.URL.Path, ":", err)
+			if r.Method == "GET" || isFormPost(r) {
+				http.Redirect(w, r, "/", http.StatusFound)
+			} else {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)))
+	})
+}
+
+// isFormPost tells whether r was sent by submitting a form of a page, such as one left open until the token expired
+func isFormPost(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data")
+}
+
+// requireAdmin is requireAuth for accounts listed in -admin-accounts
+func requireAdmin(next http.HandlerFunc) http.Handler {
+	return requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if account := authenticatedUser(r).Account; !isAdmin(account) {
+			log.Println("non admin tried to access admin page: ", account)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// authenticatedUser returns the claims stored by requireAuth
+func authenticatedUser(r *http.Request) *Claims {
+	return r.Context().Value(claimsContextKey).(*Claims)
+}
+
+// newTokenId generates a random jti for a JWT
+func newTokenId() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		log.Fatal("error generating token id: ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func isTokenRevoked(claims *Claims) bool {
+	issuedAt := claims.IssuedAtMs
+	if issuedAt == 0 {
+		// issued before tokens carried milliseconds
+		issuedAt = claims.IssuedAt * 1000
+	}
+	checkTokenProto := &entrytaskproto.CheckToken{
+		TokenId:  claims.StandardClaims.Id,
+		Account:  claims.Account,
+		IssuedAt: issuedAt,
+	}
+	payload, err := proto.Marshal(checkTokenProto)
+	if err != nil {
+		log.Fatal("error marshalling checkTokenProto", err)
+	}
+	buffer := sendPayloadAndReceiveBuffer(5, payload) // 5 for check token
+	response := &entrytaskproto.Response{}
+	if err := proto.Unmarshal(buffer, response); err != nil {
+		log.Fatalln("Failed to parse reply from TCP: ", err)
+	}
+	// anything other than an explicit 1 is treated as revoked
+	return response.GetStatus() != 1
+}
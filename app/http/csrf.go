@@ -0,0 +1,96 @@
+/*
+CSRF protection using the double-submit cookie pattern.
+Every visitor gets a random csrf_token cookie, the templates echo it back as a hidden form field,
+and a POST is only let through when the field matches the cookie.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	CSRFCookieName = "csrf_token"
+	CSRFFieldName  = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+const csrfContextKey contextKey = 1
+
+var (
+	cookieSecure   = flag.Bool("cookie-secure", false, "only send cookies over HTTPS, turn on when served behind TLS")
+	cookieHTTPOnly = flag.Bool("cookie-httponly", true, "hide cookies from javascript")
+	cookieSameSite = flag.String("cookie-samesite", "lax", "SameSite attribute of cookies, one of lax, strict or none")
+)
+
+// newCookie builds a cookie with the security attributes from the command line
+func newCookie(name string, value string, expires time.Time) *http.Cookie {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   *cookieSecure,
+		HttpOnly: *cookieHTTPOnly,
+	}
+	switch strings.ToLower(*cookieSameSite) {
+	case "strict":
+		c.SameSite = http.SameSiteStrictMode
+	case "none":
+		// browsers drop SameSite=None cookies that are not also Secure
+		c.SameSite = http.SameSiteNoneMode
+		c.Secure = true
+	default:
+		c.SameSite = http.SameSiteLaxMode
+	}
+	return c
+}
+
+// clearCookie tells the browser to drop the cookie straight away
+func clearCookie(w http.ResponseWriter, name string) {
+	c := newCookie(name, "", time.Time{})
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+}
+
+// csrfProtect hands out the csrf cookie and rejects POSTs that do not echo it back
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if c, err := r.Cookie(CSRFCookieName); err == nil && c.Value != "" {
+			token = c.Value
+		}
+
+		if r.Method == "POST" {
+			submitted := r.Header.Get(CSRFHeaderName)
+			if submitted == "" {
+				submitted = r.FormValue(CSRFFieldName)
+			}
+			if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(submitted)) != 1 {
+				log.Println("csrf token mismatch on", r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		if token == "" {
+			// first visit so hand out a token, it lives as long as the browser session
+			token = newTokenId()
+			http.SetCookie(w, newCookie(CSRFCookieName, token, time.Time{}))
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfContextKey, token)))
+	})
+}
+
+// csrfToken returns the token the templates need to put in their forms
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfContextKey).(string)
+	return token
+}
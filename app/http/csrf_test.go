@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// csrfRequest sends a request through csrfProtect and returns the response and the token the handler was given,
+// which is empty when the handler was not reached
+func csrfRequest(method string, cookie string, field string, header string) (*httptest.ResponseRecorder, string) {
+	reached, given := false, ""
+	handler := csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached, given = true, csrfToken(r)
+	}))
+
+	form := url.Values{}
+	if field != "" {
+		form.Set(CSRFFieldName, field)
+	}
+	r := httptest.NewRequest(method, "/userpage", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != "" {
+		r.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: cookie})
+	}
+	if header != "" {
+		r.Header.Set(CSRFHeaderName, header)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if !reached {
+		return w, ""
+	}
+	return w, given
+}
+
+func TestCSRFRejectsPostsWithoutToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie string
+		field  string
+		header string
+		want   int
+	}{
+		{"no cookie or field", "", "", "", http.StatusForbidden},
+		{"field without cookie", "", "token", "", http.StatusForbidden},
+		{"cookie without field", "token", "", "", http.StatusForbidden},
+		{"field not matching the cookie", "token", "other", "", http.StatusForbidden},
+		{"field with a prefix of the cookie", "token", "tok", "", http.StatusForbidden},
+		{"header not matching the cookie", "token", "", "other", http.StatusForbidden},
+		{"header not matching while the field does", "token", "token", "other", http.StatusForbidden},
+		{"field matching the cookie", "token", "token", "", http.StatusOK},
+		{"header matching the cookie", "token", "", "token", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, given := csrfRequest("POST", test.cookie, test.field, test.header)
+			if w.Code != test.want {
+				t.Fatalf("status %d, want %d", w.Code, test.want)
+			}
+			if test.want == http.StatusOK && given != test.cookie {
+				t.Errorf("handler given token %q, want %q", given, test.cookie)
+			} else if test.want != http.StatusOK && given != "" {
+				t.Errorf("rejected request reached the handler")
+			}
+		})
+	}
+}
+
+func TestCSRFHandsOutToken(t *testing.T) {
+	w, given := csrfRequest("GET", "", "", "")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != CSRFCookieName || cookies[0].Value == "" {
+		t.Fatalf("first visit got cookies %v, want a %s cookie", cookies, CSRFCookieName)
+	}
+	if given != cookies[0].Value {
+		t.Errorf("handler given token %q, the cookie holds %q", given, cookies[0].Value)
+	}
+
+	// the token handed out lets the next POST through, and is kept rather than replaced
+	w, given = csrfRequest("POST", cookies[0].Value, cookies[0].Value, "")
+	if w.Code != http.StatusOK || given != cookies[0].Value {
+		t.Fatalf("POST with the token handed out: status %d, token %q", w.Code, given)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("token replaced with %v", cookies)
+	}
+}
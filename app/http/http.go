@@ -8,6 +8,7 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	entrytaskproto "git.garena.com/wilber.chaowb/yanfeng-entry-task/protobuf_files/entry-task-proto"
 	"github.com/dgrijalva/jwt-go"
@@ -20,6 +21,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -40,9 +42,34 @@ type TCPConnectionPool struct {
 
 var connectionPool *TCPConnectionPool
 
+var trustProxy = flag.Bool("trust-proxy", false, "take the client IP from X-Forwarded-For, only when running behind a reverse proxy")
+
+// loginPage is what login.gtpl renders
+type loginPage struct {
+	CSRFToken string
+	Message   string
+}
+
+// userPage is what userpage.gtpl renders
+type userPage struct {
+	Nickname    string
+	TotpEnabled bool
+	Version     int // sent back with updates so they fail if the profile changed in the meantime
+	Message     string
+	CSRFToken   string
+}
+
+// conflictMessage is shown when an update lost to another session, see redirectConflict
+const conflictMessage = "Your profile was changed in another session, check it and try again"
+
+// lockedMessage is shown when too many wrong two-factor codes were sent to turn 2FA off
+const lockedMessage = "Too many wrong codes, try again later"
+
 type Claims struct {
-	Id      int    `json:"id"`
-	Account string `json:"account"`
+	Id         int    `json:"id"`
+	Account    string `json:"account"`
+	MFAPending bool   `json:"mfa,omitempty"` // password checked but the TOTP code is still missing
+	IssuedAtMs int64  `json:"iat_ms"`        // iat in unix milliseconds, so revoking sessions spares a login in the same second
 	jwt.StandardClaims
 }
 
@@ -51,16 +78,17 @@ const (
 	PORT             = "9001"
 	TYPE             = "tcp"
 	BufferHeaderSize = 4 // Because 4 bytes is an integer
+	TokenLifetime    = 5 * time.Minute
 )
 
 func login(w http.ResponseWriter, r *http.Request) {
 	log.Println("Method for login: ", r.Method) //get request method
 	if r.Method == "GET" {
 		// check the token here if it exists
-		if !checkValidCookie(w, r) {
-			fmt.Println("invalid cookie")
+		if _, err := authenticate(r); err != nil {
+			fmt.Println("invalid cookie:", err)
 			t, _ := template.ParseFiles("./HTML_Pages/login.gtpl")
-			t.Execute(w, nil)
+			t.Execute(w, loginPage{CSRFToken: csrfToken(r)})
 			return
 		} else {
 			// token is correct and not expired so go to userpage
@@ -75,6 +103,7 @@ func login(w http.ResponseWriter, r *http.Request) {
 		login := &entrytaskproto.Login{
 			Account:  strings.Join(r.Form["account"], ""),
 			Password: strings.Join(r.Form["password"], ""),
+			Ip:       clientIP(r),
 		}
 		payload, err := proto.Marshal(login)
 		if err != nil {
@@ -91,40 +120,28 @@ func login(w http.ResponseWriter, r *http.Request) {
 			// need to redirect back to login
 			http.Redirect(w, r, "/", http.StatusFound)
 		} else if reply.GetStatus() == 1 {
-			// generate jwt token and issue it here
-			// Declare the expiration time of the token
-			// here, we have kept it as 5 minutes
-			expirationTime := time.Now().Add(5 * time.Minute)
-			// Create the JWT claims, which includes the username and expiry time
-			claims := &Claims{
-				// add id here
-				Id:      int(reply.GetId()),
-				Account: r.FormValue("account"),
-				StandardClaims: jwt.StandardClaims{
-					// In JWT, the expiry time is expressed as unix milliseconds
-					ExpiresAt: expirationTime.Unix(),
-				},
-			}
-
-			// Declare the token with the algorithm used for signing, and the claims
-			token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-			// Create the JWT string
-			tokenString, err := token.SignedString(secretKey)
-			if err != nil {
-				// If there is an error in creating the JWT return an internal server error
-				fmt.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-
-			// Finally, we set the client cookie for "token" as the JWT we just generated
-			// we also set an expiry time which is the same as the token itself
-			http.SetCookie(w, &http.Cookie{
-				Name:    "token",
-				Value:   tokenString,
-				Expires: expirationTime,
+			issueToken(w, r, int(reply.GetId()), r.FormValue("account"), false)
+		} else if reply.GetStatus() == 3 {
+			// password was right but 2FA is on, so hand out a short lived token that only works for the code page
+			issueToken(w, r, int(reply.GetId()), r.FormValue("account"), true)
+		} else if reply.GetStatus() == 2 {
+			// too many failed logins so tell the user when to try again
+			fmt.Println("locked out for", reply.GetRetryAfter(), "seconds")
+			w.Header().Set("Retry-After", strconv.Itoa(int(reply.GetRetryAfter())))
+			w.WriteHeader(http.StatusTooManyRequests)
+			t, _ := template.ParseFiles("./HTML_Pages/login.gtpl")
+			t.Execute(w, loginPage{
+				CSRFToken: csrfToken(r),
+				Message:   fmt.Sprintf("Too many failed logins, try again in %d seconds", reply.GetRetryAfter()),
+			})
+		} else if reply.GetStatus() == 5 {
+			// disabled by an admin
+			w.WriteHeader(http.StatusForbidden)
+			t, _ := template.ParseFiles("./HTML_Pages/login.gtpl")
+			t.Execute(w, loginPage{
+				CSRFToken: csrfToken(r),
+				Message:   "This account has been disabled",
 			})
-			http.Redirect(w, r, "/userpage", http.StatusFound)
 		} else if reply.GetStatus() == -1 {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
@@ -134,6 +151,65 @@ func login(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// issueToken signs a JWT for the user and sends them on to the userpage, or to the TOTP page when mfaPending
+func issueToken(w http.ResponseWriter, r *http.Request, id int, account string, mfaPending bool) {
+	// generate jwt token and issue it here
+	// Declare the expiration time of the token
+	// here, we have kept it as 5 minutes
+	issuedAt := time.Now()
+	expirationTime := issuedAt.Add(TokenLifetime)
+	// Create the JWT claims, which includes the username and expiry time
+	claims := &Claims{
+		// add id here
+		Id:         id,
+		Account:    account,
+		MFAPending: mfaPending,
+		IssuedAtMs: issuedAt.UnixMilli(),
+		StandardClaims: jwt.StandardClaims{
+			// jti so that this token can be revoked on logout
+			Id:       newTokenId(),
+			IssuedAt: issuedAt.Unix(),
+			// In JWT, the expiry time is expressed as unix milliseconds
+			ExpiresAt: expirationTime.Unix(),
+		},
+	}
+
+	// Declare the token with the algorithm used for signing, and the claims
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	// Create the JWT string
+	tokenString, err := token.SignedString(secretKey)
+	if err != nil {
+		// If there is an error in creating the JWT return an internal server error
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if mfaPending {
+		http.SetCookie(w, newCookie(MFACookieName, tokenString, expirationTime))
+		http.Redirect(w, r, "/login/totp", http.StatusFound)
+		return
+	}
+	// Finally, we set the client cookie for "token" as the JWT we just generated
+	// we also set an expiry time which is the same as the token itself
+	http.SetCookie(w, newCookie("token", tokenString, expirationTime))
+	http.Redirect(w, r, "/userpage", http.StatusFound)
+}
+
+// clientIP returns the address of the client, taken from X-Forwarded-For only when -trust-proxy is set
+func clientIP(r *http.Request) string {
+	if *trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func sendPayloadAndReceiveBuffer(typeOfMessage int, payload []byte) (bufferWithResponse []byte) {
 	request := &entrytaskproto.Req{
 		TypeOfMessage: int32(typeOfMessage),
@@ -164,23 +240,38 @@ func sendPayloadAndReceiveBuffer(typeOfMessage int, payload []byte) (bufferWithR
 
 	// Parse reply from TCP server
 	buffer := make([]byte, BufferHeaderSize)
-	_, err = conn.connection.Read(buffer)
+	_, err = io.ReadFull(conn.connection, buffer)
 	if err != nil {
 		fmt.Println("error reading buffer header from TCP ", err)
+		release(redial(conn))
+		return nil
 	}
 	messageLength := int(binary.LittleEndian.Uint32(buffer))
 
 	buffer = make([]byte, messageLength)
 
-	// read serialised information from the socket
-	_, err = conn.connection.Read(buffer)
+	// read serialised information from the socket, a large reply such as the audit log takes more than one read
+	_, err = io.ReadFull(conn.connection, buffer)
 	if err != nil {
 		fmt.Println("error reading serialised information from TCP ", err)
+		release(redial(conn))
+		return nil
 	}
 	release(conn)
 	return buffer
 }
 
+// redial replaces a connection whose reply could not be read, what is left of it would be taken for the next reply
+func redial(connection tcpConn) tcpConn {
+	connection.connection.Close()
+	conn, err := net.Dial(TYPE, HOST+":"+PORT)
+	if err != nil {
+		log.Fatal("failed to reopen connection for connpool: ", err)
+	}
+	connection.connection = conn
+	return connection
+}
+
 func hashSHA256(stringToHash string) string {
 	h := sha1.New()
 	h.Write([]byte(stringToHash))
@@ -190,28 +281,37 @@ func hashSHA256(stringToHash string) string {
 
 func userpage(w http.ResponseWriter, r *http.Request) {
 	log.Println("Method for userpage: ", r.Method) //get request method
-	if !checkValidCookie(w, r) {
-		fmt.Println("invalid cookie so go back to login")
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
-	}
+	user := authenticatedUser(r)
 	if r.Method == "GET" {
-		nickname, fileName := getNicknameAndFileName(r)
+		status, nickname, fileName, totpEnabled, version := getNicknameAndFileName(user)
+		if status == 0 {
+			redirectLoggedOut(w, r)
+			return
+		} else if status != 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 		t, _ := template.ParseFiles("HTML_Pages/userpage.gtpl")
 
 		// find file and insert into HTML
 		relativeFilePath := "Images/" + fileName
 		fmt.Fprintf(w, "<html><img src=\""+relativeFilePath+"\" alt='no image set yet' style='width:235px;height:320px;'></html>")
-		t.ExecuteTemplate(w, "userpage", nickname)
+		page := userPage{Nickname: nickname, TotpEnabled: totpEnabled, Version: version, CSRFToken: csrfToken(r)}
+		if r.URL.Query().Get("error") == "conflict" {
+			page.Message = conflictMessage
+		} else if r.URL.Query().Get("error") == "locked" {
+			page.Message = lockedMessage
+		}
+		t.ExecuteTemplate(w, "userpage", page)
 	} else {
 		r.ParseForm()
 		// logic part of updating MySQL table
-		id, account := getIdAndAccountName(r)
 		if r.Form["nickname"] != nil {
 			updateNicknameProto := &entrytaskproto.UpdateNickname{
-				Id:       int32(id),
-				Account:  account,
+				Id:       int32(user.Id),
+				Account:  user.Account,
 				Nickname: strings.Join(r.Form["nickname"], ""),
+				Version:  formVersion(r),
 			}
 			payload, err := proto.Marshal(updateNicknameProto)
 			if err != nil {
@@ -226,45 +326,45 @@ func userpage(w http.ResponseWriter, r *http.Request) {
 			if response.GetStatus() == 1 {
 				// success so redirect
 				http.Redirect(w, r, "/userpage", http.StatusFound)
+			} else if response.GetStatus() == 4 {
+				redirectConflict(w, r)
 			} else if response.GetStatus() == 0 {
-				log.Fatal("failed to update nickname")
+				redirectLoggedOut(w, r)
 			} else {
-				log.Fatal("unexpected error")
+				log.Println("error updating nickname, status: ", response.GetStatus())
+				w.WriteHeader(http.StatusInternalServerError)
 			}
 		}
 	}
 }
 
-func getIdAndAccountName(r *http.Request) (id int, account string) {
-	c, err := r.Cookie("token") // Get the JWT string from the cookie
+// formVersion is the profile version the page was rendered with
+func formVersion(r *http.Request) int32 {
+	version, err := strconv.Atoi(r.FormValue("version"))
 	if err != nil {
-		log.Fatal("Error reading token for some reason: ", err)
+		// no version can never match, so the update is refused as a conflict
+		return 0
 	}
-	tknStr := c.Value
+	return int32(version)
+}
 
-	// Initialize a new instance of `Claims`
-	claims := &Claims{}
+// redirectConflict sends the user back to their page, reloaded with the other session's changes
+func redirectConflict(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/userpage?error=conflict", http.StatusFound)
+}
 
-	// Parse the JWT string and store the result in `claims`.
-	// Note that we are passing the key in this method as well. This method will return an error
-	// if the token is invalid (if it has expired according to the expiry time we set on sign in),
-	// or if the signature does not match
-	tkn, err := jwt.ParseWithClaims(tknStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return secretKey, nil
-	})
-	claims, ok := tkn.Claims.(*Claims)
-	if !ok || !tkn.Valid {
-		fmt.Println("there was an error making the claims")
-		fmt.Println(err)
-	}
-	return claims.Id, claims.Account
+// redirectLoggedOut drops the token of a user the TCP server has no account for any more, and sends them to log in.
+// Disabling or deleting an account revokes its tokens, this catches requests that raced that.
+func redirectLoggedOut(w http.ResponseWriter, r *http.Request) {
+	clearCookie(w, "token")
+	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func getNicknameAndFileName(r *http.Request) (nickname string, fileName string) {
-	id, account := getIdAndAccountName(r)
+// getNicknameAndFileName reads the profile of user, status is 1 when it was read, 0 when there is no such user and -1 on errors
+func getNicknameAndFileName(user *Claims) (status int, nickname string, fileName string, totpEnabled bool, version int) {
 	getNicknameandFileNameProto := &entrytaskproto.GetNicknameAndFileName{
-		Id:      int32(id),
-		Account: account,
+		Id:      int32(user.Id),
+		Account: user.Account,
 	}
 	payload, err := proto.Marshal(getNicknameandFileNameProto)
 	if err != nil {
@@ -276,56 +376,43 @@ func getNicknameAndFileName(r *http.Request) (nickname string, fileName string)
 	if err := proto.Unmarshal(buffer, replyWithNicknameAndFileName); err != nil {
 		log.Fatalln("Failed to parse reply from TCP: ", err)
 	}
-	return replyWithNicknameAndFileName.GetNickname(), replyWithNicknameAndFileName.GetImagePath()
+	return int(replyWithNicknameAndFileName.GetStatus()), replyWithNicknameAndFileName.GetNickname(), replyWithNicknameAndFileName.GetImagePath(),
+		replyWithNicknameAndFileName.GetTotpEnabled(), int(replyWithNicknameAndFileName.GetVersion())
 }
 
-func checkValidCookie(w http.ResponseWriter, r *http.Request) bool {
-	c, err := r.Cookie("token")
-	if err != nil {
-		if err == http.ErrNoCookie {
-			log.Println("no token so login again")
-			return false
-		}
-		// For any other type of error, return a bad request status
-		log.Println("bad request")
-		w.WriteHeader(http.StatusBadRequest)
-		return false
+func logout(w http.ResponseWriter, r *http.Request) {
+	log.Println("Method for logout: ", r.Method) //get request method
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/userpage", http.StatusFound)
+		return
 	}
-	// Get the JWT string from the cookie
-	tknStr := c.Value
-
-	// Initialize a new instance of `Claims`
-	claims := &Claims{}
-
-	// Parse the JWT string and store the result in `claims`.
-	// Note that we are passing the key in this method as well. This method will return an error
-	// if the token is invalid (if it has expired according to the expiry time we set on sign in),
-	// or if the signature does not match
-	tkn, err := jwt.ParseWithClaims(tknStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return secretKey, nil
-	})
-	if err != nil {
-		if err == jwt.ErrSignatureInvalid {
-			w.WriteHeader(http.StatusUnauthorized)
-			return false
+	if claims, err := authenticate(r); err == nil {
+		// deny the token for the rest of its lifetime in case it was copied elsewhere
+		revokeTokenProto := &entrytaskproto.RevokeToken{
+			TokenId:   claims.StandardClaims.Id,
+			ExpiresAt: claims.ExpiresAt,
+		}
+		payload, err := proto.Marshal(revokeTokenProto)
+		if err != nil {
+			log.Fatal("error marshalling revokeTokenProto", err)
+		}
+		buffer := sendPayloadAndReceiveBuffer(4, payload) // 4 for revoke token
+		response := &entrytaskproto.Response{}
+		if err := proto.Unmarshal(buffer, response); err != nil {
+			log.Fatalln("Failed to parse reply from TCP: ", err)
+		}
+		if response.GetStatus() != 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
-		w.WriteHeader(http.StatusBadRequest)
-		return false
-	}
-	if !tkn.Valid {
-		// expired token so login again
-		return false
 	}
-	return true
+	// clear the cookie on the client
+	clearCookie(w, "token")
+	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func uploadImage(w http.ResponseWriter, r *http.Request) {
 	log.Println("Method for uploadImage: ", r.Method) //get request method
-	if !checkValidCookie(w, r) {
-		fmt.Println("invalid cookie so go back to login")
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
-	}
 	if r.Method == "GET" {
 		http.Redirect(w, r, "/userpage", http.StatusFound)
 	} else {
@@ -339,7 +426,7 @@ func uploadImage(w http.ResponseWriter, r *http.Request) {
 		defer file.Close()
 		// has file name with a random number, store it with the file extension
 		fileExtension := filepath.Ext(handler.Filename)
-		handler.Filename = hashSHA256(time.Now().String()+string(rand.Int63())) + fileExtension
+		handler.Filename = hashSHA256(time.Now().String()+strconv.FormatInt(rand.Int63(), 10)) + fileExtension
 		f, err := os.OpenFile("./Images/"+handler.Filename, os.O_WRONLY|os.O_CREATE, 0666)
 		if err != nil {
 			fmt.Println(err)
@@ -349,12 +436,13 @@ func uploadImage(w http.ResponseWriter, r *http.Request) {
 		io.Copy(f, file)
 
 		// Delete previous copy
-		id, account := getIdAndAccountName(r)
+		user := authenticatedUser(r)
 
 		updateFileNameProto := &entrytaskproto.UpdateFileName{
-			Id:       int32(id),
-			Account:  account,
+			Id:       int32(user.Id),
+			Account:  user.Account,
 			FileName: handler.Filename,
+			Version:  formVersion(r),
 		}
 		payload, err := proto.Marshal(updateFileNameProto)
 		if err != nil {
@@ -367,9 +455,9 @@ func uploadImage(w http.ResponseWriter, r *http.Request) {
 			log.Fatalln("Failed to parse reply from TCP: ", err)
 		}
 		if response.GetStatus() == 1 {
-			// success so redirect and delete old file
+			// success so redirect and delete old file, if there was one
 			relativeFilePath := "Images/" + response.GetOldFileName()
-			if _, err := os.Stat(relativeFilePath); err == nil {
+			if _, err := os.Stat(relativeFilePath); err == nil && response.GetOldFileName() != "" {
 				// file exists so delete it
 				e := os.Remove(relativeFilePath)
 				if e != nil {
@@ -377,19 +465,41 @@ func uploadImage(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 			http.Redirect(w, r, "/userpage", http.StatusFound)
-		} else if response.GetStatus() == 0 {
-			log.Fatal("failed to update fileName")
+		} else if response.GetStatus() == 4 {
+			// the new image was never used so it goes instead
+			if e := os.Remove("Images/" + handler.Filename); e != nil {
+				log.Println("error deleting unused image: ", e)
+			}
+			redirectConflict(w, r)
 		} else {
-			log.Fatal("unexpected error")
+			// the new image was never used so it goes instead
+			if e := os.Remove("Images/" + handler.Filename); e != nil {
+				log.Println("error deleting unused image: ", e)
+			}
+			if response.GetStatus() == 0 {
+				redirectLoggedOut(w, r)
+			} else {
+				log.Println("error updating fileName, status: ", response.GetStatus())
+				w.WriteHeader(http.StatusInternalServerError)
+			}
 		}
 	}
 }
 
 func setupRoutes() {
 	http.HandleFunc("/", login)
-	http.HandleFunc("/userpage", userpage)
-	http.HandleFunc("/upload", uploadImage)
-	err := http.ListenAndServe(":8081", nil) // setting listening port
+	http.Handle("/userpage", requireAuth(userpage))
+	http.Handle("/upload", requireAuth(uploadImage))
+	http.HandleFunc("/logout", logout)
+	http.HandleFunc("/login/totp", loginTotp)
+	http.Handle("/2fa/enroll", requireAuth(enrollTotp))
+	http.Handle("/2fa/confirm", requireAuth(confirmTotp))
+	http.Handle("/2fa/disable", requireAuth(disableTotp))
+	http.Handle("/admin", requireAdmin(admin))
+	http.Handle("/admin/revoke", requireAdmin(adminRevokeSessions))
+	http.Handle("/admin/audit", requireAdmin(adminAudit))
+	http.Handle("/admin/status", requireAdmin(adminSetAccountStatus))
+	err := http.ListenAndServe(":8081", csrfProtect(http.DefaultServeMux)) // setting listening port
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
@@ -411,6 +521,8 @@ func release(connection tcpConn) {
 }
 
 func main() {
+	flag.Parse()
+
 	// Make the connection pool here
 	maxIdleConnection := 1000000
 	connectionPool = &TCPConnectionPool{
@@ -419,7 +531,7 @@ func main() {
 	for i := 0; i < maxIdleConnection; i++ {
 		conn, err := net.Dial(TYPE, HOST+":"+PORT)
 		tcpConnection := tcpConn{
-			id:         string(i),
+			id:         strconv.Itoa(i),
 			connection: conn,
 		}
 		if err != nil {
@@ -0,0 +1,192 @@
+/*
+Pages for TOTP two-factor authentication, the second login step plus enrolling and disabling it
+*/
+
+package main
+
+import (
+	"fmt"
+	entrytaskproto "git.garena.com/wilber.chaowb/yanfeng-entry-task/protobuf_files/entry-task-proto"
+	"google.golang.org/protobuf/proto"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MFACookieName holds the token issued after the password but before the TOTP code
+const MFACookieName = "mfa_token"
+
+// totpPage is what totp.gtpl renders
+type totpPage struct {
+	Step          string // "login", "enroll" or "recovery"
+	Secret        string
+	URI           template.URL
+	RecoveryCodes []string
+	Message       string
+	CSRFToken     string
+}
+
+func renderTotp(w http.ResponseWriter, page totpPage) {
+	t, err := template.ParseFiles("HTML_Pages/totp.gtpl")
+	if err != nil {
+		log.Println("error parsing totp template: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	t.ExecuteTemplate(w, "totp", page)
+}
+
+// otpauthURL lets the otpauth:// scheme through html/template, which would otherwise replace it as unsafe
+func otpauthURL(uri string) template.URL {
+	if !strings.HasPrefix(uri, "otpauth://") {
+		return ""
+	}
+	return template.URL(uri)
+}
+
+func sendTotpCode(typeOfMessage int, user *Claims, code string, ip string) []byte {
+	totpCodeProto := &entrytaskproto.TotpCode{
+		Id:      int32(user.Id),
+		Account: user.Account,
+		Code:    strings.TrimSpace(code),
+		Ip:      ip,
+	}
+	payload, err := proto.Marshal(totpCodeProto)
+	if err != nil {
+		log.Fatal("error marshalling totpCodeProto", err)
+	}
+	return sendPayloadAndReceiveBuffer(typeOfMessage, payload)
+}
+
+// loginTotp is the second step of logging in for users with 2FA on
+func loginTotp(w http.ResponseWriter, r *http.Request) {
+	log.Println("Method for loginTotp: ", r.Method) //get request method
+	user, err := parseTokenCookie(r, MFACookieName)
+	if err != nil || !user.MFAPending {
+		// took too long or skipped the password
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if r.Method == "GET" {
+		renderTotp(w, totpPage{Step: "login", CSRFToken: csrfToken(r)})
+		return
+	}
+
+	buffer := sendTotpCode(9, user, r.FormValue("code"), clientIP(r)) // 9 for verify login code
+	reply := &entrytaskproto.Response{}
+	if err := proto.Unmarshal(buffer, reply); err != nil {
+		log.Fatalln("Failed to parse reply from TCP: ", err)
+	}
+	if reply.GetStatus() == 1 {
+		clearCookie(w, MFACookieName)
+		issueToken(w, r, user.Id, user.Account, false)
+	} else if reply.GetStatus() == 0 {
+		renderTotp(w, totpPage{Step: "login", Message: "Wrong code", CSRFToken: csrfToken(r)})
+	} else if reply.GetStatus() == 2 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(reply.GetRetryAfter())))
+		w.WriteHeader(http.StatusTooManyRequests)
+		renderTotp(w, totpPage{
+			Step:      "login",
+			Message:   fmt.Sprintf("Too many failed logins, try again in %d seconds", reply.GetRetryAfter()),
+			CSRFToken: csrfToken(r),
+		})
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// enrollTotp generates a secret and shows it so the user can add it to their authenticator app
+func enrollTotp(w http.ResponseWriter, r *http.Request) {
+	log.Println("Method for enrollTotp: ", r.Method) //get request method
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/userpage", http.StatusFound)
+		return
+	}
+	user := authenticatedUser(r)
+	totpEnrollProto := &entrytaskproto.TotpEnroll{
+		Id:      int32(user.Id),
+		Account: user.Account,
+	}
+	payload, err := proto.Marshal(totpEnrollProto)
+	if err != nil {
+		log.Fatal("error marshalling totpEnrollProto", err)
+	}
+	buffer := sendPayloadAndReceiveBuffer(7, payload) // 7 for begin enrollment
+	reply := &entrytaskproto.TotpEnrollment{}
+	if err := proto.Unmarshal(buffer, reply); err != nil {
+		log.Fatalln("Failed to parse reply from TCP: ", err)
+	}
+	if reply.GetStatus() == 1 {
+		renderTotp(w, totpPage{
+			Step:      "enroll",
+			Secret:    reply.GetSecret(),
+			URI:       otpauthURL(reply.GetUri()),
+			CSRFToken: csrfToken(r),
+		})
+	} else if reply.GetStatus() == 0 {
+		// already on
+		http.Redirect(w, r, "/userpage", http.StatusFound)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// confirmTotp turns 2FA on with the first code from the app and shows the recovery codes once
+func confirmTotp(w http.ResponseWriter, r *http.Request) {
+	log.Println("Method for confirmTotp: ", r.Method) //get request method
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/userpage", http.StatusFound)
+		return
+	}
+	buffer := sendTotpCode(8, authenticatedUser(r), r.FormValue("code"), clientIP(r)) // 8 for confirm enrollment
+	reply := &entrytaskproto.TotpEnrollment{}
+	if err := proto.Unmarshal(buffer, reply); err != nil {
+		log.Fatalln("Failed to parse reply from TCP: ", err)
+	}
+	if reply.GetStatus() == 1 {
+		renderTotp(w, totpPage{Step: "recovery", RecoveryCodes: reply.GetRecoveryCodes(), CSRFToken: csrfToken(r)})
+	} else if reply.GetStatus() == 0 {
+		renderTotp(w, totpPage{
+			Step:      "enroll",
+			Secret:    r.FormValue("secret"),
+			URI:       otpauthURL(r.FormValue("uri")),
+			Message:   "Wrong code, check the time on your device and try again",
+			CSRFToken: csrfToken(r),
+		})
+	} else if reply.GetStatus() == 2 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(reply.GetRetryAfter())))
+		w.WriteHeader(http.StatusTooManyRequests)
+		renderTotp(w, totpPage{
+			Step:      "enroll",
+			Secret:    r.FormValue("secret"),
+			URI:       otpauthURL(r.FormValue("uri")),
+			Message:   fmt.Sprintf("Too many wrong codes, try again in %d seconds", reply.GetRetryAfter()),
+			CSRFToken: csrfToken(r),
+		})
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func disableTotp(w http.ResponseWriter, r *http.Request) {
+	log.Println("Method for disableTotp: ", r.Method) //get request method
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/userpage", http.StatusFound)
+		return
+	}
+	buffer := sendTotpCode(10, authenticatedUser(r), r.FormValue("code"), clientIP(r)) // 10 for disable
+	reply := &entrytaskproto.Response{}
+	if err := proto.Unmarshal(buffer, reply); err != nil {
+		log.Fatalln("Failed to parse reply from TCP: ", err)
+	}
+	if reply.GetStatus() == 1 || reply.GetStatus() == 0 {
+		// a wrong code just leaves 2FA on
+		http.Redirect(w, r, "/userpage", http.StatusFound)
+	} else if reply.GetStatus() == 2 {
+		http.Redirect(w, r, "/userpage?error=locked", http.StatusFound)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/*
+Account status changes made by admins, and the last login time which is written in the background
+so a login does not wait on it
+*/
+
+const lastLoginQueueSize = 1024
+
+type lastLogin struct {
+	id int
+	at time.Time
+}
+
+var lastLogins = make(chan lastLogin, lastLoginQueueSize)
+
+// recordLogin queues the last login time of a user for writeLastLogins, dropping it when the queue is full
+// rather than holding up the login, the next login of the user records it again
+func recordLogin(id int) {
+	select {
+	case lastLogins <- lastLogin{id: id, at: dbNow()}:
+	default:
+		log.Println("last login queue full, not recording the login of", id)
+	}
+}
+
+func writeLastLogins() {
+	for login := range lastLogins {
+		if err := users.RecordLogin(ctx, login.id, login.at); err != nil {
+			log.Println("error recording last login of", login.id, ": ", err)
+		}
+	}
+}
+
+/*
+setAccountStatus deactivates, reactivates or deletes an account. Anything other than active also logs
+the account out everywhere, ttlSeconds is the lifetime of a token as in revokeAllSessions.
+status: 0 for no such account or an unknown status, 1 for success, -1 for db errors
+*/
+func setAccountStatus(account string, status string, actor string, ttlSeconds int64) int {
+	id, oldStatus, err := users.SetStatus(ctx, account, status)
+	if err == ErrUserNotFound || err == ErrBadStatus {
+		log.Println("cannot set status of", account, "to", status, ": ", err)
+		return 0
+	} else if err != nil {
+		log.Println("error setting account status: ", err)
+		return -1
+	}
+	// the cached entry still has the old status
+	uncacheUser(id, account)
+	if status != StatusActive {
+		if err := revokeAllSessions(account, ttlSeconds); err != nil {
+			log.Println("error revoking sessions of", account, ": ", err)
+			return -1
+		}
+	}
+	log.Printf("%s set the status of %s from %s to %s\n", actor, account, oldStatus, status)
+	recordAudit(AuditEvent{Account: account, Actor: actor, Event: AuditStatusChanged, OldValue: oldStatus, NewValue: status})
+	return 1
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	entrytaskproto "git.garena.com/wilber.chaowb/yanfeng-entry-task/protobuf_files/entry-task-proto"
+	"log"
+	"time"
+)
+
+/*
+Audit log of authentication and profile events, kept in the audit_events table.
+Events are queued and written by one goroutine so logins do not wait on the insert,
+a full queue slows requests down rather than dropping events.
+There is no way to change a password yet, so there is no event for it.
+*/
+
+const (
+	AuditLoginSuccess     = "login_success"
+	AuditLoginFailure     = "login_failure" // new_value says why, see the loginFailure reasons
+	AuditNicknameChanged  = "nickname_changed"
+	AuditPictureChanged   = "picture_changed"
+	AuditTotpEnabled      = "totp_enabled"
+	AuditTotpDisabled     = "totp_disabled"
+	AuditRecoveryCodeUsed = "recovery_code_used" // new_value is how many are left
+	AuditSessionsRevoked  = "sessions_revoked"
+	AuditStatusChanged    = "status_changed"
+
+	auditQueueSize    = 1024
+	MaxAuditQueryRows = 500
+)
+
+// reasons a login failed, stored as the new_value of AuditLoginFailure
+const (
+	loginFailureWrongPassword = "wrong password"
+	loginFailureNoAccount     = "no such account"
+	loginFailureLockedOut     = "locked out"
+	loginFailureWrongCode     = "wrong two-factor code"
+	loginFailureDisabled      = "account disabled"
+)
+
+// AuditEvent is a row of the audit_events table
+type AuditEvent struct {
+	Id       int64
+	At       time.Time // UTC
+	Account  string
+	Actor    string // admin account, empty when the user did it themselves
+	Event    string
+	IP       string
+	OldValue string
+	NewValue string
+}
+
+// AuditQuery selects events by account, all accounts when empty, between Since and Until
+type AuditQuery struct {
+	Account string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+type AuditLog interface {
+	Record(ctx context.Context, event AuditEvent) error
+	// Query returns the newest matching events first
+	Query(ctx context.Context, query AuditQuery) ([]AuditEvent, error)
+}
+
+var auditLog AuditLog
+
+var auditQueue = make(chan AuditEvent, auditQueueSize)
+
+// recordAudit queues an event for writeAuditEvents, stamped with the current time
+func recordAudit(event AuditEvent) {
+	event.At = dbNow()
+	auditQueue <- event
+}
+
+// writeAuditEvents writes queued events to auditLog until the server stops
+func writeAuditEvents() {
+	for event := range auditQueue {
+		if err := auditLog.Record(ctx, event); err != nil {
+			log.Printf("error writing audit event %s of %s: %v\n", event.Event, event.Account, err)
+		}
+	}
+}
+
+/*
+queryAuditEvents answers the admin audit page
+status: 1 for success, -1 for db errors
+*/
+func queryAuditEvents(query *entrytaskproto.QueryAuditEvents) *entrytaskproto.AuditEvents {
+	auditQuery := AuditQuery{Account: query.GetAccount(), Limit: int(query.GetLimit())}
+	if query.GetSince() > 0 {
+		auditQuery.Since = time.Unix(query.GetSince(), 0)
+	}
+	if query.GetUntil() > 0 {
+		auditQuery.Until = time.Unix(query.GetUntil(), 0)
+	}
+	events, err := auditLog.Query(ctx, auditQuery)
+	if err != nil {
+		log.Println("error querying audit log: ", err)
+		return &entrytaskproto.AuditEvents{Status: -1}
+	}
+	reply := &entrytaskproto.AuditEvents{Status: 1}
+	for _, event := range events {
+		reply.Events = append(reply.Events, &entrytaskproto.AuditEvent{
+			Id:       event.Id,
+			At:       event.At.UnixMilli(),
+			Account:  event.Account,
+			Actor:    event.Actor,
+			Event:    event.Event,
+			Ip:       event.IP,
+			OldValue: event.OldValue,
+			NewValue: event.NewValue,
+		})
+	}
+	return reply
+}
+
+// sqlAuditLog is the AuditLog in the audit_events table of the primary database
+type sqlAuditLog struct {
+	insert        *sql.Stmt
+	queryAccount  *sql.Stmt
+	queryAccounts *sql.Stmt
+}
+
+const selectAuditEvent = "SELECT id, created_at, account, actor, event, ip, old_value, new_value FROM audit_events"
+
+func newSQLAuditLog(ctx context.Context, db *sql.DB) (*sqlAuditLog, error) {
+	l := &sqlAuditLog{}
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&l.insert, "INSERT INTO audit_events (created_at, account, actor, event, ip, old_value, new_value) VALUES (?, ?, ?, ?, ?, ?, ?)"},
+		{&l.queryAccount, selectAuditEvent + " WHERE account=? AND created_at>=? AND created_at<? ORDER BY created_at DESC, id DESC LIMIT ?"},
+		{&l.queryAccounts, selectAuditEvent + " WHERE created_at>=? AND created_at<? ORDER BY created_at DESC, id DESC LIMIT ?"},
+	}
+	for _, s := range statements {
+		stmt, err := db.PrepareContext(ctx, s.query)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("preparing %q: %w", s.query, err)
+		}
+		*s.stmt = stmt
+	}
+	return l, nil
+}
+
+func (l *sqlAuditLog) Close() error {
+	for _, stmt := range []*sql.Stmt{l.insert, l.queryAccount, l.queryAccounts} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return nil
+}
+
+func (l *sqlAuditLog) Record(ctx context.Context, event AuditEvent) error {
+	_, err := l.insert.ExecContext(ctx, event.At, event.Account, event.Actor, event.Event, event.IP, event.OldValue, event.NewValue)
+	return err
+}
+
+func (l *sqlAuditLog) Query(ctx context.Context, query AuditQuery) ([]AuditEvent, error) {
+	if query.Limit <= 0 || query.Limit > MaxAuditQueryRows {
+		query.Limit = MaxAuditQueryRows
+	}
+	if query.Until.IsZero() {
+		query.Until = time.Now().Add(time.Minute)
+	}
+	since, until := query.Since.UTC(), query.Until.UTC()
+
+	var rows *sql.Rows
+	var err error
+	if query.Account != "" {
+		rows, err = l.queryAccount.QueryContext(ctx, query.Account, since, until, query.Limit)
+	} else {
+		rows, err = l.queryAccounts.QueryContext(ctx, since, until, query.Limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var event AuditEvent
+		var at dbTime
+		err := rows.Scan(&event.Id, &at, &event.Account, &event.Actor, &event.Event, &event.IP, &event.OldValue, &event.NewValue)
+		if err != nil {
+			return nil, err
+		}
+		event.At = at.Time
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuditQueryFilters(t *testing.T) {
+	audit, err := newSQLAuditLog(ctx, newSQLiteUsers(t).db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	// new_value names the event, the last two are at the same time
+	recorded := []AuditEvent{
+		{At: start, Account: "alice", NewValue: "1"},
+		{At: start.Add(time.Minute), Account: "bob", NewValue: "2"},
+		{At: start.Add(2*time.Minute + 500*time.Millisecond), Account: "alice", NewValue: "3"},
+		{At: start.Add(3 * time.Minute), Account: "alice", NewValue: "4"},
+		{At: start.Add(3 * time.Minute), Account: "bob", NewValue: "5"},
+	}
+	for _, event := range recorded {
+		event.Event = AuditLoginSuccess
+		if err := audit.Record(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query AuditQuery
+		want  []string
+	}{
+		{"everything", AuditQuery{}, []string{"5", "4", "3", "2", "1"}},
+		{"one account", AuditQuery{Account: "alice"}, []string{"4", "3", "1"}},
+		{"no such account", AuditQuery{Account: "carol"}, nil},
+		{"since is included", AuditQuery{Since: start.Add(time.Minute)}, []string{"5", "4", "3", "2"}},
+		{"until is left out", AuditQuery{Until: start.Add(3 * time.Minute)}, []string{"3", "2", "1"}},
+		{"within a millisecond", AuditQuery{Since: start.Add(2*time.Minute + 500*time.Millisecond), Until: start.Add(2*time.Minute + 501*time.Millisecond)}, []string{"3"}},
+		{"account between", AuditQuery{Account: "bob", Since: start.Add(time.Second), Until: start.Add(time.Hour)}, []string{"5", "2"}},
+		{"limit keeps the newest", AuditQuery{Limit: 2}, []string{"5", "4"}},
+		{"limit of an account", AuditQuery{Account: "alice", Limit: 1}, []string{"4"}},
+		{"in another time zone", AuditQuery{Since: start.In(time.FixedZone("UTC+8", 8*3600)).Add(time.Minute)}, []string{"5", "4", "3", "2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, err := audit.Query(ctx, test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, event := range events {
+				got = append(got, event.NewValue)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got events %v, want %v", got, test.want)
+			}
+		})
+	}
+}
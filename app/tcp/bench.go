@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+The bench-cache subcommand measures how long a cached profile read takes, comparing the round trip per
+field profiles used to be read with against the single pipeline of cachedUser. Like wrk in the stress test,
+-c clients read the profiles of random users at once for -d. It caches the first -n users of the database
+first, fill it with the seed subcommand before.
+
+	go run ./app/tcp -- bench-cache
+	go run ./app/tcp -- bench-cache -n 200 -c 150 -d 5s
+*/
+
+// benchOptions are the flags of the bench-cache subcommand
+type benchOptions struct {
+	users    int
+	clients  int
+	duration time.Duration
+}
+
+func parseBenchOptions(args []string) (benchOptions, error) {
+	var options benchOptions
+	flags := flag.NewFlagSet("bench-cache", flag.ContinueOnError)
+	flags.IntVar(&options.users, "n", 200, "number of users to read the profiles of")
+	flags.IntVar(&options.clients, "c", 150, "concurrent readers")
+	flags.DurationVar(&options.duration, "d", 5*time.Second, "how long each way of reading runs")
+	if err := flags.Parse(args); err != nil {
+		return options, err
+	}
+	if options.users < 1 || options.clients < 1 || options.duration <= 0 {
+		return options, errors.New("-n, -c and -d have to be positive")
+	}
+	return options, nil
+}
+
+// runBenchCommand handles the bench-cache subcommand, args are what follows "bench-cache"
+func runBenchCommand(ctx context.Context, db *sql.DB, args []string) error {
+	options, err := parseBenchOptions(args)
+	if err != nil {
+		return err
+	}
+	client, err := newRedisClient()
+	if err != nil {
+		return err
+	}
+	if err := client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("connecting to redis: %w", err)
+	}
+	defer client.Close()
+
+	ids, err := cacheBenchUsers(ctx, db, client, options.users)
+	if err != nil {
+		return err
+	}
+	cache := &redisProfileCache{client: client, strategy: CacheAside}
+	fmt.Printf("%d users, %d clients, %s each\n", len(ids), options.clients, options.duration)
+	fmt.Printf("%-14s %10s %10s %10s %10s\n", "read", "reads/s", "p50", "p99", "max")
+	for _, way := range []struct {
+		name string
+		read func(ctx context.Context, id int) error
+	}{
+		{"field-by-field", func(ctx context.Context, id int) error {
+			return readFieldByField(ctx, client, id)
+		}},
+		{"pipelined", func(ctx context.Context, id int) error {
+			_, ok, err := cache.cachedUser(ctx, id)
+			if err == nil && !ok {
+				err = fmt.Errorf("user %d is not cached", id)
+			}
+			return err
+		}},
+	} {
+		latencies, elapsed, err := benchReads(ctx, ids, options, way.read)
+		if err != nil {
+			return fmt.Errorf("%s: %w", way.name, err)
+		}
+		fmt.Printf("%-14s %10.0f %10s %10s %10s\n", way.name, float64(len(latencies))/elapsed.Seconds(),
+			percentile(latencies, 0.5), percentile(latencies, 0.99), latencies[len(latencies)-1])
+	}
+	return nil
+}
+
+// cacheBenchUsers caches the first n users of the database and returns their ids
+func cacheBenchUsers(ctx context.Context, db *sql.DB, client redis.UniversalClient, n int) ([]int, error) {
+	rows, err := db.QueryContext(ctx, selectUser+" ORDER BY id LIMIT ?", n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	pipe := client.Pipeline()
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, user.Id)
+		pipeProfile(ctx, pipe, user, 0)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no users to read, run seed first")
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("caching the users: %w", err)
+	}
+	return ids, nil
+}
+
+// readFieldByField reads a cached profile the way it was read before cachedUser, a round trip to check it is there and one per field
+func readFieldByField(ctx context.Context, client redis.UniversalClient, id int) error {
+	key := profileKey(id)
+	exists, err := client.HExists(ctx, key, "version").Result()
+	if err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("user %d is not cached", id)
+	}
+	for _, field := range profileFields {
+		if err := client.HGet(ctx, key, field).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// benchReads runs read from options.clients goroutines for options.duration, returning every latency sorted
+// and how long the reads took. The first read to fail stops the others and is the error returned.
+func benchReads(ctx context.Context, ids []int, options benchOptions, read func(ctx context.Context, id int) error) ([]time.Duration, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, options.duration)
+	defer cancel()
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var firstErr error
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < options.clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var mine []time.Duration
+			for ctx.Err() == nil {
+				readStart := time.Now()
+				if err := read(ctx, ids[rand.Intn(len(ids))]); err != nil {
+					mu.Lock()
+					if firstErr == nil && ctx.Err() == nil {
+						// reads cut short by the end or by another failure are not the error
+						firstErr = err
+						cancel()
+					}
+					mu.Unlock()
+					break
+				}
+				mine = append(mine, time.Since(readStart))
+			}
+			mu.Lock()
+			latencies = append(latencies, mine...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+	if len(latencies) == 0 {
+		return nil, 0, errors.New("no reads finished")
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	return latencies, elapsed, nil
+}
+
+// percentile of sorted latencies, p between 0 and 1
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	return latencies[int(p*float64(len(latencies)-1))]
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+Circuit breaker in front of redis, so the server keeps answering from the database while redis is down.
+Every command sent to redis goes through redisBreaker. After -redis-breaker-failures failures in a row the
+breaker opens, and every command fails at once with ErrRedisUnavailable instead of waiting on a dead connection.
+Every -redis-breaker-cooldown redis is pinged, and once it answers the cached users that could not be invalidated
+meanwhile are, before the breaker closes and the server caches again.
+
+Meanwhile profiles are read from and written to the database, logins skip the credentials cache, and failed
+logins and revoked tokens are kept in memory, where this server keeps checking them after redis is back. Tokens
+revoked on other servers pass the revocation check meanwhile, see revocation.go.
+The breaker opening and closing is logged, and counted with the commands it turned away in redis_breaker.
+*/
+
+var (
+	redisBreakerFailures = flag.Int("redis-breaker-failures", 5, "redis failures in a row after which the server stops using redis for a while")
+	redisBreakerCooldown = flag.Duration("redis-breaker-cooldown", 5*time.Second, "how long the server stops using redis before trying again")
+)
+
+// ErrRedisUnavailable is what redis commands fail with while the breaker is open, and what the errors that open it wrap
+var ErrRedisUnavailable = errors.New("redis unavailable")
+
+var redisStats = expvar.NewMap("redis_breaker")
+
+var redisBreaker = &circuitBreaker{}
+
+func init() {
+	redisStats.Set("open", expvar.Func(func() interface{} {
+		return redisBreaker.isOpen()
+	}))
+}
+
+// redisFailure is a failed redis command, errors.Is matches it with ErrRedisUnavailable
+type redisFailure struct {
+	err error
+}
+
+func (e redisFailure) Error() string {
+	return "redis unavailable: " + e.err.Error()
+}
+
+func (e redisFailure) Unwrap() error {
+	return e.err
+}
+
+func (e redisFailure) Is(target error) bool {
+	return target == ErrRedisUnavailable
+}
+
+// redisUnavailable tells whether err means redis could not be reached, rather than a miss or an error in the command
+func redisUnavailable(err error) bool {
+	return errors.Is(err, ErrRedisUnavailable)
+}
+
+// isRedisFailure tells whether err counts against redis, a missing key, a lost WATCH, an error reply
+// or a command the caller gave up on do not
+func isRedisFailure(err error) bool {
+	var reply redis.Error
+	return err != nil && err != redis.Nil && err != redis.TxFailedErr && !errors.As(err, &reply) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// circuitBreaker is a redis.Hook, added to the client by newRedisClient
+type circuitBreaker struct {
+	client redis.UniversalClient // the one it was added to, pinged by probe
+
+	mu       sync.Mutex
+	failures int // in a row
+	open     bool
+}
+
+// probing marks the context of the commands of probe, which go to redis while the breaker is open
+type probing struct{}
+
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// allow turns commands away while the breaker is open, except those of probe
+func (b *circuitBreaker) allow(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open && ctx.Value(probing{}) == nil {
+		redisStats.Add("turned_away", 1)
+		return ErrRedisUnavailable
+	}
+	return nil
+}
+
+// report counts the outcome of a command that reached redis, err is the error of the command
+func (b *circuitBreaker) report(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isRedisFailure(err) {
+		// only probe closes the breaker, this may be a command that was sent before it opened
+		b.failures = 0
+		return
+	}
+	redisStats.Add("failures", 1)
+	b.failures++
+	if !b.open && b.failures >= *redisBreakerFailures {
+		log.Println("redis is failing, using the database only: ", err)
+		redisStats.Add("opened", 1)
+		b.open = true
+		go b.probe()
+	}
+}
+
+// probe waits for redis to answer again, then drops what went stale meanwhile and closes the breaker
+func (b *circuitBreaker) probe() {
+	probeCtx := context.WithValue(ctx, probing{}, true)
+	for {
+		time.Sleep(*redisBreakerCooldown)
+		if err := b.client.Ping(probeCtx).Err(); err != nil {
+			continue
+		}
+		if err := invalidateStale(probeCtx, b.client); err != nil {
+			log.Println("error dropping cached users changed while redis was unavailable: ", err)
+			continue
+		}
+		b.mu.Lock()
+		b.open = false
+		b.failures = 0
+		b.mu.Unlock()
+		log.Println("redis is back, caching again")
+		redisStats.Add("closed", 1)
+		// users written by requests turned away while the breaker was closing
+		if err := invalidateStale(ctx, b.client); err != nil {
+			log.Println("error dropping cached users changed while redis was unavailable: ", err)
+		}
+		return
+	}
+}
+
+// after reports err and returns what the command fails with instead, nil to leave its error alone
+func (b *circuitBreaker) after(err error) error {
+	if err == ErrRedisUnavailable {
+		// turned away by allow, redis was not tried
+		return nil
+	}
+	b.report(err)
+	if isRedisFailure(err) {
+		return redisFailure{err: err}
+	}
+	return nil
+}
+
+func (b *circuitBreaker) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, b.allow(ctx)
+}
+
+func (b *circuitBreaker) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return b.after(cmd.Err())
+}
+
+func (b *circuitBreaker) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, b.allow(ctx)
+}
+
+// AfterProcessPipeline fails every command of the pipeline when one of them failed, they share the connection
+func (b *circuitBreaker) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var failed error
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err == ErrRedisUnavailable || isRedisFailure(err) {
+			failed = err
+			break
+		}
+	}
+	return b.after(failed)
+}
+
+// staleUsers are what could not be invalidated while redis was unavailable
+var staleUsers = struct {
+	sync.Mutex
+	profiles    map[int]bool
+	credentials map[string]bool // by account
+}{
+	profiles:    make(map[int]bool),
+	credentials: make(map[string]bool),
+}
+
+// markStaleProfile has the cached profile of id invalidated once redis is back
+func markStaleProfile(id int) {
+	staleUsers.Lock()
+	defer staleUsers.Unlock()
+	staleUsers.profiles[id] = true
+}
+
+// markStaleCredentials has the cached credentials of account invalidated once redis is back
+func markStaleCredentials(account string) {
+	staleUsers.Lock()
+	defer staleUsers.Unlock()
+	staleUsers.credentials[account] = true
+}
+
+// invalidateStale drops what was marked stale while redis was unavailable, and marks it again if that fails
+func invalidateStale(ctx context.Context, client redis.UniversalClient) error {
+	staleUsers.Lock()
+	ids, accounts := staleUsers.profiles, staleUsers.credentials
+	staleUsers.profiles, staleUsers.credentials = make(map[int]bool), make(map[string]bool)
+	staleUsers.Unlock()
+	if len(ids) == 0 && len(accounts) == 0 {
+		return nil
+	}
+
+	pipe := client.Pipeline()
+	for id := range ids {
+		pipe.Del(ctx, profileKey(id))
+		// every server, this one included, drops its in-memory copy
+		pipe.Publish(ctx, profileInvalidationChannel, id)
+	}
+	for account := range accounts {
+		pipeUncacheCredentials(ctx, pipe, account)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		for id := range ids {
+			markStaleProfile(id)
+		}
+		for account := range accounts {
+			markStaleCredentials(account)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// replyError is an error reply of redis
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+func (replyError) RedisError() {}
+
+func TestIsRedisFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no error", nil, false},
+		{"missing key", redis.Nil, false},
+		{"lost watch", redis.TxFailedErr, false},
+		{"error reply", replyError("WRONGTYPE Operation against a key holding the wrong kind of value"), false},
+		{"canceled", context.Canceled, false},
+		{"timed out by the caller", fmt.Errorf("reading: %w", context.DeadlineExceeded), false},
+		{"connection closed", io.EOF, true},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRedisFailure(test.err); got != test.want {
+				t.Errorf("isRedisFailure(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+// setBreaker makes the breaker open after failures and probe every cooldown for the test
+func setBreaker(t *testing.T, failures int, cooldown time.Duration) {
+	oldFailures, oldCooldown := *redisBreakerFailures, *redisBreakerCooldown
+	*redisBreakerFailures, *redisBreakerCooldown = failures, cooldown
+	t.Cleanup(func() {
+		*redisBreakerFailures, *redisBreakerCooldown = oldFailures, oldCooldown
+	})
+}
+
+func TestBreakerAfter(t *testing.T) {
+	setBreaker(t, 1000, time.Minute)
+	b := &circuitBreaker{}
+	tests := []struct {
+		name        string
+		err         error
+		wantFailure bool // the command fails with a redisFailure wrapping err
+	}{
+		{"no error", nil, false},
+		{"turned away", ErrRedisUnavailable, false},
+		{"missing key", redis.Nil, false},
+		{"error reply", replyError("ERR"), false},
+		{"connection closed", io.EOF, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := b.after(test.err)
+			if !test.wantFailure {
+				if err != nil {
+					t.Errorf("after(%v) = %v, want nil", test.err, err)
+				}
+				return
+			}
+			if !redisUnavailable(err) || !errors.Is(err, test.err) {
+				t.Errorf("after(%v) = %v, want a redis failure wrapping it", test.err, err)
+			}
+		})
+	}
+}
+
+func TestBreakerAllowsOnlyProbesWhileOpen(t *testing.T) {
+	b := &circuitBreaker{}
+	probeCtx := context.WithValue(ctx, probing{}, true)
+	if err := b.allow(ctx); err != nil {
+		t.Errorf("closed breaker turned a command away: %v", err)
+	}
+	b.open = true
+	if err := b.allow(ctx); err != ErrRedisUnavailable {
+		t.Errorf("open breaker allowed a command: %v", err)
+	}
+	if err := b.allow(probeCtx); err != nil {
+		t.Errorf("open breaker turned the probe away: %v", err)
+	}
+}
+
+func TestBreakerOpensAndCloses(t *testing.T) {
+	setBreaker(t, 3, 5*time.Millisecond)
+	fake := newFakeRedis()
+	client := redis.NewClient(&redis.Options{Dialer: fake.dial, MaxRetries: -1, PoolSize: 1000})
+	defer client.Close()
+	b := &circuitBreaker{client: client}
+	client.AddHook(b)
+	set := func() error {
+		return client.Set(ctx, "key", "value", 0).Err()
+	}
+
+	// failures are only counted in a row
+	fake.setUp(true)
+	rounds := 2 * *redisBreakerFailures
+	for i := 0; i < rounds; i++ {
+		fake.setUp(false)
+		if err := set(); !redisUnavailable(err) || err == ErrRedisUnavailable {
+			t.Fatalf("command %d while redis is down: %v, want the failure", i, err)
+		}
+		fake.setUp(true)
+		if err := set(); err != nil {
+			t.Fatalf("command %d while redis is up: %v", i, err)
+		}
+	}
+	if b.isOpen() {
+		t.Fatal("breaker opened without failures in a row")
+	}
+
+	fake.setUp(false)
+	for i := 0; i < *redisBreakerFailures; i++ {
+		set()
+	}
+	if !b.isOpen() {
+		t.Fatalf("breaker closed after %d failures in a row", *redisBreakerFailures)
+	}
+	dials := atomic.LoadInt32(&fake.dials)
+	if err := set(); err != ErrRedisUnavailable {
+		t.Errorf("command while the breaker is open: %v, want ErrRedisUnavailable", err)
+	}
+	if atomic.LoadInt32(&fake.dials) != dials {
+		t.Error("command turned away by the breaker dialed redis")
+	}
+
+	// probe keeps pinging, and drops what went stale once redis answers
+	markStaleProfile(42)
+	markStaleCredentials("alice")
+	time.Sleep(5 * *redisBreakerCooldown)
+	if !b.isOpen() {
+		t.Fatal("breaker closed while redis is down")
+	}
+	fake.setUp(true)
+	for deadline := time.Now().Add(2 * time.Second); b.isOpen(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("breaker still open after redis came back")
+		}
+	}
+	if err := set(); err != nil {
+		t.Errorf("command after the breaker closed: %v", err)
+	}
+	for _, command := range []string{
+		"ping",
+		"del " + profileKey(42),
+		"publish " + profileInvalidationChannel + " 42",
+		"publish " + credentialInvalidationChannel + " alice",
+	} {
+		if !fake.received(command) {
+			t.Errorf("redis did not receive %q", command)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"math/rand"
+	"time"
+)
+
+/*
+ProfileCache sits between the logic in tcp.go and the UserRepository, so the handlers read and
+update profiles the same way whichever caching strategy -cache picks:
+
+	none           every read and write goes to the database
+	cache-aside    reads fill the cache on a miss, writes go to the database and drop the cached user
+	write-through  reads fill the cache on a miss, writes go to the database and then to the cache
+	write-behind   writes go to the cache and are queued for the database, see writeBehindProfileCache
+	read-through   only the cache loads users from the database, after writes too, nothing else puts values in it
+
+TOTP and account status changes always go straight to the database and then Invalidate the cached user,
+a security setting must not wait in a queue.
+
+A read that missed before a write can still put the profile it read in the cache after the write, where it
+stays until it expires. cache-aside only ever deletes, so such a read fills the cache with the old profile
+only when it is slower than the write, and -cache-delete-again deletes the cached user once more after every
+write to drop that too. Compare the cache with the database with the check-cache subcommand.
+
+Every cached profile expires after -cache-ttl, give or take -cache-ttl-jitter so the users cached by one busy
+minute do not all miss in the same one later. Concurrent misses of one profile share a single database read,
+and -cache-early-refresh lets a read refresh a profile about to expire before anyone misses it.
+Hits, misses, database loads, early refreshes and expiries are counted in profile_cache in the metrics.
+In front of redis each server keeps the latest profiles it read in memory, see localProfileCache.
+*/
+
+const (
+	CacheNone         = "none"
+	CacheAside        = "cache-aside"
+	CacheWriteThrough = "write-through"
+	CacheWriteBehind  = "write-behind"
+	CacheReadThrough  = "read-through"
+)
+
+var (
+	cacheStrategy = flag.String("cache", "", "profile cache strategy: none, cache-aside, write-through, write-behind or read-through. "+
+		"Takes precedence over y/n, which mean write-through and none")
+	cacheTTL           = flag.Duration("cache-ttl", 30*time.Minute, "how long a cached profile lives, 0 to keep it until it is invalidated")
+	cacheTTLJitter     = flag.Float64("cache-ttl-jitter", 0.1, "fraction of -cache-ttl the lifetime of each cached profile is randomly moved by")
+	cacheRefreshOnRead = flag.Bool("cache-refresh-on-read", false, "start the TTL of a cached profile again whenever it is read")
+	cacheEarlyRefresh  = flag.Float64("cache-early-refresh", 0, "beta of the probabilistic early refresh of cached profiles, 1 is usual "+
+		"and higher refreshes earlier, 0 turns it off")
+	cacheDeleteAgain = flag.Duration("cache-delete-again", 0, "delete the cached user a second time this long after a write, "+
+		"longer than a database read takes, 0 turns it off")
+	cacheNotifyExpired = flag.Bool("cache-notify-expired", false, "turn on the expired keyspace notifications of redis with CONFIG SET, "+
+		"which changes them for every client of the server, to count expired profiles")
+)
+
+// deleteAgain runs invalidate a second time after -cache-delete-again, unless that is 0
+func deleteAgain(invalidate func() error) {
+	if *cacheDeleteAgain <= 0 {
+		return
+	}
+	time.AfterFunc(*cacheDeleteAgain, func() {
+		cacheStats.Add("deleted_again", 1)
+		if err := invalidate(); err != nil {
+			log.Println("error deleting cached user again: ", err)
+		}
+	})
+}
+
+// cacheStats counts hits, misses and expired entries of the profile cache
+var cacheStats = expvar.NewMap("profile_cache")
+
+// profileTTL is -cache-ttl moved by up to -cache-ttl-jitter either way, 0 when profiles do not expire
+func profileTTL() time.Duration {
+	if *cacheTTL <= 0 {
+		return 0
+	}
+	jitter := (rand.Float64()*2 - 1) * *cacheTTLJitter * float64(*cacheTTL)
+	return *cacheTTL + time.Duration(jitter)
+}
+
+// ProfileCache reads and updates users like UserRepository does, a user read from the cache only has the fields in cachedFields
+type ProfileCache interface {
+	GetByID(ctx context.Context, id int) (User, error)
+	GetByAccount(ctx context.Context, account string) (User, error)
+	// UpdateNickname and UpdatePicture behave like the ones of UserRepository
+	UpdateNickname(ctx context.Context, id int, nickname string, expectedVersion int) (oldNickname string, version int, err error)
+	UpdatePicture(ctx context.Context, id int, fileName string, expectedVersion int) (oldFileName string, version int, err error)
+	// Invalidate drops the cached user so the next read goes to the database, for writes the cache did not make
+	Invalidate(ctx context.Context, id int) error
+}
+
+var profiles ProfileCache
+
+// newProfileCache returns the ProfileCache for strategy in front of users, client is not used by CacheNone
+func newProfileCache(strategy string, client redis.UniversalClient, users UserRepository) (ProfileCache, error) {
+	expvar.NewString("cache_strategy").Set(strategy)
+	var cache ProfileCache
+	if strategy == CacheNone {
+		return noProfileCache{users: users}, nil
+	} else if strategy == CacheAside || strategy == CacheWriteThrough || strategy == CacheReadThrough {
+		cache = &redisProfileCache{client: client, users: users, strategy: strategy}
+	} else if strategy == CacheWriteBehind {
+		cache = newWriteBehindProfileCache(client, users)
+	} else {
+		return nil, fmt.Errorf("unknown cache strategy %q", strategy)
+	}
+	go countExpiredProfiles(client)
+	if *localCacheSize > 0 {
+		cache = newLocalProfileCache(cache, client)
+	}
+	return cache, nil
+}
+
+// noProfileCache is the ProfileCache of CacheNone
+type noProfileCache struct {
+	users UserRepository
+}
+
+func (c noProfileCache) GetByID(ctx context.Context, id int) (User, error) {
+	return c.users.GetByID(ctx, id)
+}
+
+func (c noProfileCache) GetByAccount(ctx context.Context, account string) (User, error) {
+	return c.users.GetByAccount(ctx, account)
+}
+
+func (c noProfileCache) UpdateNickname(ctx context.Context, id int, nickname string, expectedVersion int) (string, int, error) {
+	return c.users.UpdateNickname(ctx, id, nickname, expectedVersion)
+}
+
+func (c noProfileCache) UpdatePicture(ctx context.Context, id int, fileName string, expectedVersion int) (string, int, error) {
+	return c.users.UpdatePicture(ctx, id, fileName, expectedVersion)
+}
+
+func (c noProfileCache) Invalidate(ctx context.Context, id int) error {
+	return nil
+}
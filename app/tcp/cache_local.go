@@ -0,0 +1,201 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"flag"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+In-process LRU of profiles in front of the redis cache, so a profile read a moment ago costs no round trip.
+Every write made through it, and every Invalidate, is published on profileInvalidationChannel and every TCP
+server sharing the redis drops its copy. Messages published while a server is reconnecting to redis are lost,
+so entries also expire after -cache-local-ttl, which is how stale a profile can get in the worst case.
+*/
+
+const profileInvalidationChannel = "profile-invalidations"
+
+var (
+	localCacheSize = flag.Int("cache-local-size", 10000, "profiles kept in memory in front of redis, 0 turns the in-memory cache off")
+	localCacheTTL  = flag.Duration("cache-local-ttl", 30*time.Second, "how long a profile is kept in memory")
+)
+
+type localProfileCache struct {
+	next   ProfileCache // the redis cache
+	client redis.UniversalClient
+
+	mu      sync.Mutex
+	entries map[int]*list.Element // user id to its element in order
+	order   *list.List            // of *localEntry, most recently used first
+	epoch   uint64                // bumped by every invalidation, see put
+}
+
+type localEntry struct {
+	user    User
+	expires time.Time
+}
+
+// newLocalProfileCache puts the in-memory cache in front of next and starts listening for invalidations
+func newLocalProfileCache(next ProfileCache, client redis.UniversalClient) *localProfileCache {
+	c := &localProfileCache{
+		next:    next,
+		client:  client,
+		entries: make(map[int]*list.Element),
+		order:   list.New(),
+	}
+	go c.listenForInvalidations()
+	return c
+}
+
+func (c *localProfileCache) get(id int) (User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[id]
+	if !ok {
+		return User{}, false
+	}
+	entry := element.Value.(*localEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, id)
+		return User{}, false
+	}
+	c.order.MoveToFront(element)
+	return entry.user, true
+}
+
+// put keeps user unless something was invalidated since epoch, when the read may have raced the write
+func (c *localProfileCache) put(user User, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.epoch != epoch {
+		return
+	}
+	entry := &localEntry{user: user, expires: time.Now().Add(*localCacheTTL)}
+	if element, ok := c.entries[user.Id]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[user.Id] = c.order.PushFront(entry)
+	for c.order.Len() > *localCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*localEntry).user.Id)
+	}
+}
+
+func (c *localProfileCache) currentEpoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+func (c *localProfileCache) drop(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	if element, ok := c.entries[id]; ok {
+		c.order.Remove(element)
+		delete(c.entries, id)
+	}
+}
+
+// dropAll empties the cache, for when invalidations may have been missed
+func (c *localProfileCache) dropAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	c.entries = make(map[int]*list.Element)
+	c.order.Init()
+}
+
+func (c *localProfileCache) GetByID(ctx context.Context, id int) (User, error) {
+	if user, ok := c.get(id); ok {
+		cacheStats.Add("local_hits", 1)
+		return user, nil
+	}
+	cacheStats.Add("local_misses", 1)
+	epoch := c.currentEpoch()
+	user, err := c.next.GetByID(ctx, id)
+	if err == nil {
+		c.put(user, epoch)
+	}
+	return user, err
+}
+
+func (c *localProfileCache) GetByAccount(ctx context.Context, account string) (User, error) {
+	epoch := c.currentEpoch()
+	user, err := c.next.GetByAccount(ctx, account)
+	if err == nil {
+		c.put(user, epoch)
+	}
+	return user, err
+}
+
+func (c *localProfileCache) UpdateNickname(ctx context.Context, id int, nickname string, expectedVersion int) (string, int, error) {
+	oldNickname, version, err := c.next.UpdateNickname(ctx, id, nickname, expectedVersion)
+	if err == nil || err == ErrVersionConflict {
+		err = c.invalidateEverywhere(ctx, id, err)
+	}
+	return oldNickname, version, err
+}
+
+func (c *localProfileCache) UpdatePicture(ctx context.Context, id int, fileName string, expectedVersion int) (string, int, error) {
+	oldFileName, version, err := c.next.UpdatePicture(ctx, id, fileName, expectedVersion)
+	if err == nil || err == ErrVersionConflict {
+		err = c.invalidateEverywhere(ctx, id, err)
+	}
+	return oldFileName, version, err
+}
+
+func (c *localProfileCache) Invalidate(ctx context.Context, id int) error {
+	err := c.next.Invalidate(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.invalidateEverywhere(ctx, id, nil)
+}
+
+// invalidateEverywhere drops the profile here and tells the other servers to, returning writeErr unless publishing fails
+func (c *localProfileCache) invalidateEverywhere(ctx context.Context, id int, writeErr error) error {
+	c.drop(id)
+	err := c.client.Publish(ctx, profileInvalidationChannel, id).Err()
+	if err != nil && !redisUnavailable(err) {
+		return err
+	}
+	// without redis the other servers keep their copy until -cache-local-ttl, or until the user is invalidated when redis is back
+	return writeErr
+}
+
+// listenForInvalidations drops the profiles other servers, and this one, publish until the server stops
+func (c *localProfileCache) listenForInvalidations() {
+	invalidations := c.client.Subscribe(ctx, profileInvalidationChannel)
+	defer invalidations.Close()
+	for {
+		message, err := invalidations.Receive(ctx)
+		if err != nil {
+			// the connection is redone on the next Receive, anything published meanwhile is lost
+			log.Println("error receiving profile invalidations, emptying the in-memory cache: ", err)
+			c.dropAll()
+			time.Sleep(time.Second)
+			continue
+		}
+		if invalidation, ok := message.(*redis.Message); ok {
+			id, err := strconv.Atoi(invalidation.Payload)
+			if err != nil {
+				log.Println("bad profile invalidation: ", invalidation.Payload)
+				continue
+			}
+			c.drop(id)
+		} else if _, ok := message.(*redis.Subscription); ok {
+			// subscribed again after losing the connection
+			c.dropAll()
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"testing"
+	"time"
+)
+
+// pausedProfiles is a ProfileCache whose GetByID reads the profile, then waits for release before returning it
+type pausedProfiles struct {
+	noProfileCache
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (p pausedProfiles) GetByID(ctx context.Context, id int) (User, error) {
+	user, err := p.noProfileCache.GetByID(ctx, id)
+	p.read <- struct{}{}
+	<-p.release
+	return user, err
+}
+
+// newTestLocalCache is a localProfileCache in front of next which, unlike newLocalProfileCache, does not listen for invalidations
+func newTestLocalCache(next ProfileCache) *localProfileCache {
+	return &localProfileCache{
+		next:    next,
+		client:  unavailableRedis(),
+		entries: make(map[int]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// setLocalCache sizes the in-memory cache for the test
+func setLocalCache(t *testing.T, size int, ttl time.Duration) {
+	oldSize, oldTTL := *localCacheSize, *localCacheTTL
+	*localCacheSize, *localCacheTTL = size, ttl
+	t.Cleanup(func() {
+		*localCacheSize, *localCacheTTL = oldSize, oldTTL
+	})
+}
+
+// TestLocalCacheDropsRacingReads writes a profile while a miss is reading it, the read must not be kept
+func TestLocalCacheDropsRacingReads(t *testing.T) {
+	setLocalCache(t, 10, time.Minute)
+	tests := []struct {
+		name         string
+		during       func(c *localProfileCache, id int) error
+		wantCached   bool
+		wantNickname string
+	}{
+		{"nothing written", func(c *localProfileCache, id int) error {
+			return nil
+		}, true, "alice"},
+		{"nickname updated", func(c *localProfileCache, id int) error {
+			_, _, err := c.UpdateNickname(ctx, id, "new", 1)
+			return err
+		}, false, "new"},
+		{"invalidated", func(c *localProfileCache, id int) error {
+			if _, _, err := c.next.UpdateNickname(ctx, id, "new", 1); err != nil {
+				return err
+			}
+			return c.Invalidate(ctx, id)
+		}, false, "new"},
+		{"another user invalidated", func(c *localProfileCache, id int) error {
+			return c.Invalidate(ctx, id+1)
+		}, false, "alice"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newMemoryUserRepository()
+			id, err := repo.Create(ctx, User{Account: "alice", Nickname: "alice"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := pausedProfiles{noProfileCache: noProfileCache{users: repo}, read: make(chan struct{}), release: make(chan struct{})}
+			c := newTestLocalCache(next)
+
+			done := make(chan error)
+			go func() {
+				_, err := c.GetByID(ctx, id)
+				done <- err
+			}()
+			<-next.read
+			if err := test.during(c, id); err != nil {
+				t.Fatal(err)
+			}
+			close(next.release)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			cached, ok := c.get(id)
+			if ok != test.wantCached {
+				t.Fatalf("cached %v (%+v), want %v", ok, cached, test.wantCached)
+			}
+			go func() {
+				<-next.read
+			}()
+			user, err := c.GetByID(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Nickname != test.wantNickname {
+				t.Errorf("nickname %q, want %q", user.Nickname, test.wantNickname)
+			}
+		})
+	}
+}
+
+func TestLocalCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	setLocalCache(t, 2, time.Minute)
+	c := newTestLocalCache(nil)
+	c.put(User{Id: 1}, 0)
+	c.put(User{Id: 2}, 0)
+	c.get(1)
+	c.put(User{Id: 3}, 0)
+
+	for id, want := range map[int]bool{1: true, 2: false, 3: true} {
+		if _, ok := c.get(id); ok != want {
+			t.Errorf("user %d cached %v, want %v", id, ok, want)
+		}
+	}
+	if c.order.Len() != 2 || len(c.entries) != 2 {
+		t.Errorf("%d in order and %d entries, want 2", c.order.Len(), len(c.entries))
+	}
+}
+
+func TestLocalCacheExpires(t *testing.T) {
+	setLocalCache(t, 10, 10*time.Millisecond)
+	c := newTestLocalCache(nil)
+	c.put(User{Id: 1}, 0)
+	if _, ok := c.get(1); !ok {
+		t.Fatal("not cached before the ttl")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.get(1); ok {
+		t.Error("cached after the ttl")
+	}
+	if c.order.Len() != 0 || len(c.entries) != 0 {
+		t.Errorf("%d in order and %d entries after expiring, want 0", c.order.Len(), len(c.entries))
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/sync/singleflight"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	profilePrefix = "profile:"
+	accountPrefix = "account:" // index from account to user id
+	// profileSchemaVersion is in every key, bump it when cachedFields changes so old entries are never read again and expire
+	profileSchemaVersion = 1
+	writeBehindQueueSize = 1024
+)
+
+// redisProfileCache keeps the profile of every user in a redis hash named by profileKey, see cachedFields.
+// It is the ProfileCache of cache-aside, write-through and read-through, which only differ in what a write does to the hash.
+type redisProfileCache struct {
+	client   redis.UniversalClient
+	users    UserRepository
+	strategy string
+	loads    singleflight.Group // keyed by the redis key being filled
+}
+
+// cachedFields are the fields of the hash cached for a user, only what their profile page shows.
+// Logins are checked against the credentials cache instead.
+func cachedFields(user User) map[string]interface{} {
+	// Multiple field values for initializing Hash data
+	value := make(map[string]interface{})
+	value["id"] = user.Id
+	value["nickname"] = user.Nickname
+	value["pictureFileName"] = user.PictureFileName
+	value["totpEnabled"] = user.TotpEnabled
+	value["version"] = user.Version
+	return value
+}
+
+// profileKey names the hash of a user, profile:v1:42, the common prefix keeps the profiles apart from the other keys in redis
+func profileKey(id int) string {
+	return fmt.Sprintf("%sv%d:%d", profilePrefix, profileSchemaVersion, id)
+}
+
+// accountKey names the id of the user of account, account:v1:alice
+func accountKey(account string) string {
+	return fmt.Sprintf("%sv%d:%s", accountPrefix, profileSchemaVersion, account)
+}
+
+// setProfileTTL gives the hash at key a new profileTTL as part of pipe
+func setProfileTTL(ctx context.Context, pipe redis.Pipeliner, key string) {
+	if ttl := profileTTL(); ttl > 0 {
+		pipe.Expire(ctx, key, ttl)
+	}
+}
+
+// profileFields are the fields cachedFields writes, in the order cachedUser reads them
+var profileFields = []string{"id", "nickname", "pictureFileName", "totpEnabled", "version"}
+
+// cachedProfile is a user read from the cache with what GetByID needs to decide on refreshing them
+type cachedProfile struct {
+	user     User
+	loadTime time.Duration // how long the database read that cached them took, 0 when unknown
+	ttl      time.Duration // left before the hash expires, only read with -cache-early-refresh
+}
+
+// cachedUser reads the hash of a user back into a User with the fields of cachedFields, ok is false on a miss.
+// A hash missing a field is a miss too, such as one a write made while the profile was not cached.
+// Everything is read in one pipeline, so the fields belong to the same version and a hit costs one round trip.
+func (c *redisProfileCache) cachedUser(ctx context.Context, id int) (cached cachedProfile, ok bool, err error) {
+	key := profileKey(id)
+	read := append(profileFields[:len(profileFields):len(profileFields)], "loadMicros")
+	var values *redis.SliceCmd
+	var ttl *redis.DurationCmd
+	_, err = c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		values = pipe.HMGet(ctx, key, read...)
+		if *cacheEarlyRefresh > 0 {
+			ttl = pipe.PTTL(ctx, key)
+		}
+		if refreshTTL := profileTTL(); *cacheRefreshOnRead && refreshTTL > 0 {
+			// a miss is cached again with a fresh TTL anyway
+			pipe.Expire(ctx, key, refreshTTL)
+		}
+		return nil
+	})
+	if err != nil {
+		return cachedProfile{}, false, fmt.Errorf("reading cached user %d: %w", id, err)
+	}
+	fields := make(map[string]string)
+	for i, value := range values.Val() {
+		if value == nil {
+			continue
+		}
+		fields[read[i]] = value.(string)
+	}
+	for _, field := range profileFields {
+		if _, ok := fields[field]; !ok {
+			return cachedProfile{}, false, nil
+		}
+	}
+	cached.user = User{
+		Nickname:        fields["nickname"],
+		PictureFileName: fields["pictureFileName"],
+		TotpEnabled:     fields["totpEnabled"] == "1",
+	}
+	if cached.user.Id, err = strconv.Atoi(fields["id"]); err != nil {
+		return cachedProfile{}, false, err
+	}
+	if cached.user.Version, err = strconv.Atoi(fields["version"]); err != nil {
+		return cachedProfile{}, false, err
+	}
+	if loadMicros, err := strconv.ParseInt(fields["loadMicros"], 10, 64); err == nil {
+		cached.loadTime = time.Duration(loadMicros) * time.Microsecond
+	}
+	if ttl != nil {
+		cached.ttl = ttl.Val()
+	}
+	return cached, true, nil
+}
+
+// set caches user, loadTime is how long reading them from the database took
+func (c *redisProfileCache) set(ctx context.Context, user User, loadTime time.Duration) error {
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipeProfile(ctx, pipe, user, loadTime)
+		return nil
+	})
+	return err
+}
+
+// pipeProfile adds caching the profile of user to pipe, and indexing it under their account.
+// An account never changes its id, so the index can outlive the profile.
+// loadTime is kept next to the profile for expiresSoon.
+func pipeProfile(ctx context.Context, pipe redis.Pipeliner, user User, loadTime time.Duration) {
+	key := profileKey(user.Id)
+	ttl := profileTTL()
+	fields := cachedFields(user)
+	fields["loadMicros"] = loadTime.Microseconds()
+	pipe.HSet(ctx, key, fields)
+	if ttl > 0 {
+		pipe.Expire(ctx, key, ttl)
+	}
+	pipe.Set(ctx, accountKey(user.Account), user.Id, ttl)
+}
+
+func (c *redisProfileCache) GetByID(ctx context.Context, id int) (User, error) {
+	cached, ok, err := c.cachedUser(ctx, id)
+	if redisUnavailable(err) {
+		cacheStats.Add("fallbacks", 1)
+		return c.users.GetByID(ctx, id)
+	} else if err != nil {
+		return User{}, err
+	} else if ok {
+		cacheStats.Add("hits", 1)
+		if *cacheEarlyRefresh > 0 && cached.expiresSoon() {
+			cacheStats.Add("early_refreshes", 1)
+			return c.load(ctx, profileKey(id), func() (User, error) {
+				return c.users.GetByID(ctx, id)
+			})
+		}
+		return cached.user, nil
+	}
+	cacheStats.Add("misses", 1)
+	return c.load(ctx, profileKey(id), func() (User, error) {
+		return c.users.GetByID(ctx, id)
+	})
+}
+
+// load reads a user from the database with read and caches them. Concurrent loads of the same key wait for
+// the first one instead of all reading the database, so a popular profile missing costs one query.
+func (c *redisProfileCache) load(ctx context.Context, key string, read func() (User, error)) (User, error) {
+	loaded, err, _ := c.loads.Do(key, func() (interface{}, error) {
+		cacheStats.Add("loads", 1)
+		start := time.Now()
+		user, err := read()
+		if err != nil {
+			return User{}, err
+		}
+		if err := c.set(ctx, user, time.Since(start)); err != nil && !redisUnavailable(err) {
+			return user, err
+		}
+		return user, nil
+	})
+	return loaded.(User), err
+}
+
+/*
+expiresSoon decides whether this read refreshes the cached profile before it expires, with the probabilistic
+early expiration of XFetch: a read refreshes when loadTime * beta * -ln(random) reaches the TTL left, so the
+closer the expiry and the slower the profile was to load, the likelier. One of the readers therefore refreshes
+a busy profile shortly before it expires, and the rest never see it missing.
+*/
+func (p cachedProfile) expiresSoon() bool {
+	if p.ttl <= 0 {
+		// negative when the profile does not expire
+		return false
+	}
+	gap := float64(p.loadTime.Microseconds()) * *cacheEarlyRefresh * -math.Log(rand.Float64())
+	return gap >= float64(p.ttl.Microseconds())
+}
+
+// GetByAccount finds the id of account in the index, reading the user from the database when it is not there
+func (c *redisProfileCache) GetByAccount(ctx context.Context, account string) (User, error) {
+	id, err := c.client.Get(ctx, accountKey(account)).Int()
+	if err == nil {
+		return c.GetByID(ctx, id)
+	} else if redisUnavailable(err) {
+		cacheStats.Add("fallbacks", 1)
+		return c.users.GetByAccount(ctx, account)
+	} else if err != redis.Nil {
+		return User{}, err
+	}
+	cacheStats.Add("misses", 1)
+	return c.load(ctx, accountKey(account), func() (User, error) {
+		return c.users.GetByAccount(ctx, account)
+	})
+}
+
+func (c *redisProfileCache) UpdateNickname(ctx context.Context, id int, nickname string, expectedVersion int) (string, int, error) {
+	oldNickname, version, err := c.users.UpdateNickname(ctx, id, nickname, expectedVersion)
+	return oldNickname, version, c.afterWrite(ctx, id, "nickname", nickname, version, err)
+}
+
+func (c *redisProfileCache) UpdatePicture(ctx context.Context, id int, fileName string, expectedVersion int) (string, int, error) {
+	oldFileName, version, err := c.users.UpdatePicture(ctx, id, fileName, expectedVersion)
+	return oldFileName, version, c.afterWrite(ctx, id, "pictureFileName", fileName, version, err)
+}
+
+// afterWrite brings the cached user up to date once field was written to the database, err is the error of that write
+func (c *redisProfileCache) afterWrite(ctx context.Context, id int, field string, value string, version int, err error) error {
+	if err == ErrVersionConflict {
+		// the cached user may be older than the one that won
+		if err := c.Invalidate(ctx, id); err != nil {
+			log.Println("error dropping cached user after a conflict: ", err)
+		}
+		return ErrVersionConflict
+	} else if err != nil {
+		return err
+	}
+
+	if c.strategy == CacheAside {
+		err = c.Invalidate(ctx, id)
+	} else if c.strategy == CacheWriteThrough {
+		key := profileKey(id)
+		_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, field, value, "version", version)
+			setProfileTTL(ctx, pipe, key)
+			return nil
+		})
+	} else if c.strategy == CacheReadThrough {
+		// not through load, a load that started before the write would cache the old profile
+		var user User
+		start := time.Now()
+		user, err = c.users.GetByID(ctx, id)
+		if err == nil {
+			err = c.set(ctx, user, time.Since(start))
+		}
+	}
+	if redisUnavailable(err) {
+		// the database has the write, the cached user is dropped once redis is back
+		markStaleProfile(id)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("updating cached user after writing %s: %w", field, err)
+	}
+	// through profiles, so the in-memory copies of every server go as well
+	deleteAgain(func() error {
+		return profiles.Invalidate(ctx, id)
+	})
+	return nil
+}
+
+// Invalidate leaves the account index alone, it stays right. While redis is unavailable the user is dropped once it is back.
+func (c *redisProfileCache) Invalidate(ctx context.Context, id int) error {
+	err := c.client.Del(ctx, profileKey(id)).Err()
+	if redisUnavailable(err) {
+		markStaleProfile(id)
+		return nil
+	}
+	return err
+}
+
+// countExpiredProfiles counts the profiles redis expires, which it only announces with keyspace notifications for
+// expired keys turned on, by whoever runs redis or with -cache-notify-expired.
+// Every master of a cluster only announces its own keys, so each is listened to.
+func countExpiredProfiles(client redis.UniversalClient) {
+	err := forEachNode(client, func(node redis.UniversalClient) {
+		go countExpiredProfilesOn(node)
+	})
+	if err != nil {
+		log.Println("error finding the redis nodes, expired profiles are not counted: ", err)
+	}
+}
+
+func countExpiredProfilesOn(node redis.UniversalClient) {
+	if *cacheNotifyExpired {
+		if err := notifyExpiredKeys(node); err != nil {
+			log.Println("error turning on keyspace notifications, expired profiles are not counted: ", err)
+			return
+		}
+	}
+	expired := node.Subscribe(ctx, fmt.Sprintf("__keyevent@%d__:expired", *redisDatabase))
+	defer expired.Close()
+	for message := range expired.Channel() {
+		if strings.HasPrefix(message.Payload, profilePrefix) {
+			cacheStats.Add("expired", 1)
+		}
+	}
+}
+
+// notifyExpiredKeys adds expired events to the notify-keyspace-events of redis, keeping the ones already on
+func notifyExpiredKeys(client redis.UniversalClient) error {
+	config, err := client.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		return err
+	}
+	events := ""
+	if len(config) == 2 {
+		events, _ = config[1].(string)
+	}
+	if strings.Contains(events, "E") && (strings.Contains(events, "x") || strings.Contains(events, "A")) {
+		return nil
+	}
+	return client.ConfigSet(ctx, "notify-keyspace-events", events+"Ex").Err()
+}
+
+/*
+writeBehindProfileCache makes nickname and picture updates in redis and queues them for the database, so an
+update costs a redis transaction instead of a database one. The version is checked against the cached user.
+If the database refuses a queued write, for example because the row was changed from outside this server,
+the write is logged and lost and the cached user dropped, by then the HTTP server has already deleted the
+picture it replaced. Reads miss writes still in the queue when the cached user is dropped before they land.
+*/
+type writeBehindProfileCache struct {
+	*redisProfileCache
+	queue chan queuedWrite
+}
+
+type queuedWrite struct {
+	id              int
+	field           string // nickname or pictureFileName
+	value           string
+	expectedVersion int
+}
+
+// newWriteBehindProfileCache also starts writing the queue to users
+func newWriteBehindProfileCache(client redis.UniversalClient, users UserRepository) *writeBehindProfileCache {
+	c := &writeBehindProfileCache{
+		redisProfileCache: &redisProfileCache{client: client, users: users, strategy: CacheWriteBehind},
+		queue:             make(chan queuedWrite, writeBehindQueueSize),
+	}
+	expvar.Publish("cache_write_behind_queued", expvar.Func(func() interface{} {
+		return len(c.queue)
+	}))
+	go c.writeQueued()
+	return c
+}
+
+func (c *writeBehindProfileCache) UpdateNickname(ctx context.Context, id int, nickname string, expectedVersion int) (string, int, error) {
+	return c.update(ctx, id, "nickname", nickname, expectedVersion)
+}
+
+func (c *writeBehindProfileCache) UpdatePicture(ctx context.Context, id int, fileName string, expectedVersion int) (string, int, error) {
+	return c.update(ctx, id, "pictureFileName", fileName, expectedVersion)
+}
+
+// update sets field in the cached user if it is still at expectedVersion, and queues the same write for the database
+func (c *writeBehindProfileCache) update(ctx context.Context, id int, field string, value string, expectedVersion int) (string, int, error) {
+	// loads the user into the cache on a miss, the version is checked against it
+	if _, err := c.GetByID(ctx, id); err != nil {
+		return "", 0, err
+	}
+	key := profileKey(id)
+	var old string
+	err := c.client.Watch(ctx, func(tx *redis.Tx) error {
+		values, err := tx.HMGet(ctx, key, field, "version").Result()
+		if err != nil {
+			return err
+		}
+		if version, _ := values[1].(string); version != strconv.Itoa(expectedVersion) {
+			// changed, or dropped, since the user read it
+			return ErrVersionConflict
+		}
+		old, _ = values[0].(string)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, field, value, "version", expectedVersion+1)
+			setProfileTTL(ctx, pipe, key)
+			return nil
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		// another update got in between
+		return "", 0, ErrVersionConflict
+	} else if redisUnavailable(err) {
+		// straight to the database until redis is back, writes still queued for the user make this one conflict
+		markStaleProfile(id)
+		cacheStats.Add("fallbacks", 1)
+		if field == "nickname" {
+			return c.users.UpdateNickname(ctx, id, value, expectedVersion)
+		}
+		return c.users.UpdatePicture(ctx, id, value, expectedVersion)
+	} else if err != nil {
+		return "", 0, err
+	}
+	c.queue <- queuedWrite{id: id, field: field, value: value, expectedVersion: expectedVersion}
+	return old, expectedVersion + 1, nil
+}
+
+// writeQueued writes the queue to the database in the order the updates were made, until the server stops
+func (c *writeBehindProfileCache) writeQueued() {
+	for write := range c.queue {
+		var err error
+		if write.field == "nickname" {
+			_, _, err = c.users.UpdateNickname(ctx, write.id, write.value, write.expectedVersion)
+		} else {
+			_, _, err = c.users.UpdatePicture(ctx, write.id, write.value, write.expectedVersion)
+		}
+		if err != nil {
+			log.Println("error writing queued", write.field, "of", write.id, "to the DB, the update is lost: ", err)
+			if err := c.Invalidate(ctx, write.id); err != nil {
+				log.Println("error dropping cached user: ", err)
+			}
+		}
+	}
+}
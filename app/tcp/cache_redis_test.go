@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestWriteBehind is a writeBehindProfileCache in fake in front of users which, unlike newWriteBehindProfileCache,
+// does not publish the length of its queue. Its writer stops with the test.
+func newTestWriteBehind(t *testing.T, fake *fakeRedis, users UserRepository) *writeBehindProfileCache {
+	client := redis.NewClient(&redis.Options{Dialer: fake.dial, MaxRetries: -1})
+	c := &writeBehindProfileCache{
+		redisProfileCache: &redisProfileCache{client: client, users: users, strategy: CacheWriteBehind},
+		queue:             make(chan queuedWrite, writeBehindQueueSize),
+	}
+	stopped := make(chan struct{})
+	go func() {
+		c.writeQueued()
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		close(c.queue)
+		<-stopped
+		client.Close()
+	})
+	return c
+}
+
+// waitFor checks done until it is true, failing the test after a second
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !done(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// TestWriteBehindFlushesInOrder makes updates in the cache, they are read back at once and reach the database in order
+func TestWriteBehindFlushesInOrder(t *testing.T) {
+	repo := newMemoryUserRepository()
+	id := addUser(t, repo, "alice", "secret")
+	c := newTestWriteBehind(t, newFakeRedis(), repo)
+
+	version, nickname := 1, "alice"
+	for i := 1; i <= 5; i++ {
+		old, newVersion, err := c.UpdateNickname(ctx, id, fmt.Sprint("nickname ", i), version)
+		if err != nil || old != nickname || newVersion != version+1 {
+			t.Fatalf("update %d = %q, %d, %v, want %q, %d", i, old, newVersion, err, nickname, version+1)
+		}
+		version, nickname = newVersion, fmt.Sprint("nickname ", i)
+	}
+	old, version, err := c.UpdatePicture(ctx, id, "new.png", version)
+	if err != nil || old != "alice.png" {
+		t.Fatalf("picture update = %q, %v, want alice.png", old, err)
+	}
+	if _, _, err := c.UpdateNickname(ctx, id, "stale", version-1); err != ErrVersionConflict {
+		t.Fatalf("update at an old version: %v, want %v", err, ErrVersionConflict)
+	}
+
+	cached, err := c.GetByID(ctx, id)
+	if err != nil || cached.Nickname != nickname || cached.PictureFileName != "new.png" || cached.Version != version {
+		t.Fatalf("read after the updates: %+v, %v", cached, err)
+	}
+	// a write applied out of order would be at the wrong version and be lost
+	waitFor(t, "the queued writes", func() bool {
+		stored, err := repo.GetByID(ctx, id)
+		return err == nil && stored.Version == version
+	})
+	stored, _ := repo.GetByID(ctx, id)
+	if stored.Nickname != nickname || stored.PictureFileName != "new.png" {
+		t.Errorf("database has %q, %q after the queue was written, want %q, new.png", stored.Nickname, stored.PictureFileName, nickname)
+	}
+}
+
+// TestWriteBehindDropsRefusedWrites changes the row outside the server, the queued write conflicts and the cached user is dropped
+func TestWriteBehindDropsRefusedWrites(t *testing.T) {
+	repo := newMemoryUserRepository()
+	id := addUser(t, repo, "alice", "secret")
+	fake := newFakeRedis()
+	c := newTestWriteBehind(t, fake, repo)
+	if _, err := c.GetByID(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.UpdateNickname(ctx, id, "outside", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cached user is still at version 1
+	if _, _, err := c.UpdateNickname(ctx, id, "lost", 1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the cached user to be dropped", func() bool {
+		return fake.ttl(profileKey(id)) == -2
+	})
+	if user, err := c.GetByID(ctx, id); err != nil || user.Nickname != "outside" || user.Version != 2 {
+		t.Errorf("read after the refused write: %q at %d, %v, want outside at 2", user.Nickname, user.Version, err)
+	}
+	if stored, _ := repo.GetByID(ctx, id); stored.Nickname != "outside" {
+		t.Errorf("database has %q, want the change made outside kept", stored.Nickname)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// turnedAway is a redis.Hook failing every command as if the breaker were open, so no redis is needed
+type turnedAway struct{}
+
+func (turnedAway) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, ErrRedisUnavailable
+}
+
+func (turnedAway) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (turnedAway) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, ErrRedisUnavailable
+}
+
+func (turnedAway) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// unavailableRedis is a client that never reaches a redis
+func unavailableRedis() *redis.Client {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:0"})
+	client.AddHook(turnedAway{})
+	return client
+}
+
+// slowUsers is a UserRepository counting the reads of GetByID, which wait for release
+type slowUsers struct {
+	*memoryUserRepository
+	reads   int32
+	release chan struct{}
+}
+
+func (r *slowUsers) GetByID(ctx context.Context, id int) (User, error) {
+	atomic.AddInt32(&r.reads, 1)
+	<-r.release
+	return r.memoryUserRepository.GetByID(ctx, id)
+}
+
+func TestLoadSharesConcurrentMisses(t *testing.T) {
+	const readers = 50
+	repo := &slowUsers{memoryUserRepository: newMemoryUserRepository(), release: make(chan struct{})}
+	id, err := repo.Create(ctx, User{Account: "alice", Nickname: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := &redisProfileCache{client: unavailableRedis(), users: repo, strategy: CacheAside}
+
+	var wg sync.WaitGroup
+	loaded := make([]User, readers)
+	errs := make([]error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			loaded[i], errs[i] = cache.load(ctx, profileKey(id), func() (User, error) {
+				return repo.GetByID(ctx, id)
+			})
+		}(i)
+	}
+	// the readers all miss while the first database read is still going
+	time.Sleep(100 * time.Millisecond)
+	close(repo.release)
+	wg.Wait()
+
+	if reads := atomic.LoadInt32(&repo.reads); reads != 1 {
+		t.Errorf("%d database reads for %d concurrent misses, want 1", reads, readers)
+	}
+	for i := range loaded {
+		if errs[i] != nil || loaded[i].Nickname != "alice" {
+			t.Errorf("reader %d: %+v, %v", i, loaded[i], errs[i])
+		}
+	}
+
+	// a later miss reads the database again
+	if _, err := cache.load(ctx, profileKey(id), func() (User, error) {
+		return repo.GetByID(ctx, id)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if reads := atomic.LoadInt32(&repo.reads); reads != 2 {
+		t.Errorf("%d database reads after the next miss, want 2", reads)
+	}
+}
+
+// TestExpiresSoon checks the share of reads refreshing early against XFetch, where it is exp(-ttl / (beta * loadTime))
+func TestExpiresSoon(t *testing.T) {
+	const reads = 20000
+	beta := *cacheEarlyRefresh
+	defer func() {
+		*cacheEarlyRefresh = beta
+	}()
+
+	tests := []struct {
+		beta     float64
+		loadTime time.Duration
+		ttl      time.Duration
+		want     float64
+	}{
+		{1, 10 * time.Millisecond, -1, 0}, // does not expire
+		{1, 0, time.Second, 0},            // load time unknown
+		{1, 10 * time.Millisecond, 10 * time.Millisecond, math.Exp(-1)},
+		{1, 10 * time.Millisecond, 5 * time.Millisecond, math.Exp(-0.5)},
+		{1, 10 * time.Millisecond, 30 * time.Millisecond, math.Exp(-3)},
+		{2, 10 * time.Millisecond, 10 * time.Millisecond, math.Exp(-0.5)},
+		{1, 10 * time.Millisecond, time.Minute, 0},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("beta %g load %s ttl %s", test.beta, test.loadTime, test.ttl), func(t *testing.T) {
+			*cacheEarlyRefresh = test.beta
+			profile := cachedProfile{loadTime: test.loadTime, ttl: test.ttl}
+			refreshed := 0
+			for i := 0; i < reads; i++ {
+				if profile.expiresSoon() {
+					refreshed++
+				}
+			}
+			if share := float64(refreshed) / reads; math.Abs(share-test.want) > 0.02 {
+				t.Errorf("%.3f of reads refreshed, want %.3f", share, test.want)
+			}
+		})
+	}
+}
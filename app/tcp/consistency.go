@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"math/rand"
+)
+
+/*
+The check-cache subcommand compares the profiles cached in redis with the database for a random sample of
+users, printing every cached user that differs and how many of the sample did. -fix deletes those entries,
+also from the memory of the running servers, so the next read caches them again. Under write-behind the cache
+runs ahead of the database until the queue is written, so some divergence right after writes is expected there.
+
+	go run ./app/tcp -- check-cache
+	go run ./app/tcp -- check-cache -n 1000 -fix
+*/
+
+// checkOptions are the flags of the check-cache subcommand
+type checkOptions struct {
+	sample int
+	fix    bool
+}
+
+func parseCheckOptions(args []string) (checkOptions, error) {
+	var options checkOptions
+	flags := flag.NewFlagSet("check-cache", flag.ContinueOnError)
+	flags.IntVar(&options.sample, "n", 100, "number of users to check")
+	flags.BoolVar(&options.fix, "fix", false, "delete the cached users that differ from the database")
+	if err := flags.Parse(args); err != nil {
+		return options, err
+	}
+	if options.sample < 1 {
+		return options, errors.New("-n has to be at least 1")
+	}
+	return options, nil
+}
+
+// runCheckCommand handles the check-cache subcommand, args are what follows "check-cache"
+func runCheckCommand(ctx context.Context, db *sql.DB, args []string) error {
+	options, err := parseCheckOptions(args)
+	if err != nil {
+		return err
+	}
+	client, err := newRedisClient()
+	if err != nil {
+		return err
+	}
+	if err := client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("connecting to redis: %w", err)
+	}
+	defer client.Close()
+
+	sample, err := sampleUsers(ctx, db, options.sample)
+	if err != nil {
+		return err
+	}
+	cache := &redisProfileCache{client: client}
+	cached, divergent := 0, 0
+	for _, user := range sample {
+		differences, ok, err := compareCachedUser(ctx, cache, user)
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		cached++
+		if len(differences) == 0 {
+			continue
+		}
+		divergent++
+		fmt.Printf("user %d (%s):", user.Id, user.Account)
+		for _, difference := range differences {
+			fmt.Print(" ", difference)
+		}
+		fmt.Println()
+		if options.fix {
+			// the servers drop the copies they keep in memory too
+			pipe := client.Pipeline()
+			pipe.Del(ctx, profileKey(user.Id))
+			pipe.Del(ctx, accountKey(user.Account))
+			pipe.Publish(ctx, profileInvalidationChannel, user.Id)
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Printf("checked %d users, %d cached, %d differ from the database\n", len(sample), cached, divergent)
+	return nil
+}
+
+// sampleUsers reads up to n users picked at random by id, fewer when ids are missing
+func sampleUsers(ctx context.Context, db *sql.DB, n int) ([]User, error) {
+	var maxID sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT MAX(id) FROM users").Scan(&maxID); err != nil {
+		return nil, err
+	} else if !maxID.Valid {
+		return nil, errors.New("no users to check")
+	}
+	if int64(n) > maxID.Int64 {
+		n = int(maxID.Int64)
+	}
+	picked := make(map[int64]bool)
+	var sample []User
+	for len(picked) < n {
+		id := rand.Int63n(maxID.Int64) + 1
+		if picked[id] {
+			continue
+		}
+		picked[id] = true
+		user, err := scanUser(db.QueryRowContext(ctx, selectUser+" WHERE id=?", id))
+		if err == ErrUserNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sample = append(sample, user)
+	}
+	return sample, nil
+}
+
+// compareCachedUser lists how the cache differs from user as read from the database, ok is false when nothing of user is cached.
+// The account index is checked too, it has to name the id of user.
+func compareCachedUser(ctx context.Context, cache *redisProfileCache, user User) (differences []string, ok bool, err error) {
+	cached, profileCached, err := cache.cachedUser(ctx, user.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	indexCached := true
+	indexed, err := cache.client.Get(ctx, accountKey(user.Account)).Int()
+	if err == redis.Nil {
+		indexCached = false
+	} else if err != nil {
+		return nil, false, err
+	}
+	if !profileCached && !indexCached {
+		return nil, false, nil
+	}
+
+	if indexCached && indexed != user.Id {
+		differences = append(differences, fmt.Sprintf("account index %d", indexed))
+	}
+	if !profileCached {
+		return differences, true, nil
+	}
+	if cached.user.Nickname != user.Nickname {
+		differences = append(differences, fmt.Sprintf("nickname %q for %q", cached.user.Nickname, user.Nickname))
+	}
+	if cached.user.PictureFileName != user.PictureFileName {
+		differences = append(differences, fmt.Sprintf("pictureFileName %q for %q", cached.user.PictureFileName, user.PictureFileName))
+	}
+	if cached.user.TotpEnabled != user.TotpEnabled {
+		differences = append(differences, fmt.Sprintf("totpEnabled %t for %t", cached.user.TotpEnabled, user.TotpEnabled))
+	}
+	if cached.user.Version != user.Version {
+		differences = append(differences, fmt.Sprintf("version %d for %d", cached.user.Version, user.Version))
+	}
+	return differences, true, nil
+}
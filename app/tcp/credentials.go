@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Cache of what a login checks, kept apart from the profile cache so the password hash of the users table
+never reaches redis. Keys and password verifiers are HMACs under the key in -credential-cache-key-file, so
+whoever can read redis learns neither the accounts nor a hash to crack offline, and entries expire after
+-credential-cache-ttl. Give every TCP server the same key file so they share the cached credentials.
+
+Changing the status or 2FA of an account deletes its entry and publishes the account on
+credentialInvalidationChannel, so a server that cached it under a key of its own drops it as well.
+Without a key file every server makes up its own key when it starts, and a new one whenever it may have
+missed an invalidation, which leaves everything it cached before unused until it expires.
+*/
+
+var (
+	credentialCacheTTL     = flag.Duration("credential-cache-ttl", 30*time.Second, "how long logins skip the DB after reading an account, 0 turns the credentials cache off")
+	credentialCacheKeyFile = flag.String("credential-cache-key-file", "", "file holding the secret key of the credentials cache, the same on every TCP server, "+
+		"a random key per server when empty")
+)
+
+const (
+	credentialsPrefix             = "credentials:"
+	credentialInvalidationChannel = "credential-invalidations"
+	minCredentialsKeySize         = 32 // bytes
+)
+
+// credentialsKey holds the []byte key of the HMACs, random until loadCredentialsKey reads the key file
+var credentialsKey atomic.Value
+
+func init() {
+	credentialsKey.Store(newCredentialsKey())
+}
+
+// credentials are the parts of a user a login needs
+type credentials struct {
+	id          int
+	verifier    string // passwordVerifier of the password hash
+	status      string
+	totpEnabled bool
+	key         []byte // the credentialsKey of verifier, it may be replaced meanwhile
+}
+
+// loadCredentialsKey reads -credential-cache-key-file, keeping the random key when there is none
+func loadCredentialsKey() error {
+	if *credentialCacheKeyFile == "" {
+		return nil
+	}
+	key, err := os.ReadFile(*credentialCacheKeyFile)
+	if err != nil {
+		return err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < minCredentialsKeySize {
+		return fmt.Errorf("%s has to hold at least %d bytes", *credentialCacheKeyFile, minCredentialsKeySize)
+	}
+	credentialsKey.Store(key)
+	return nil
+}
+
+func newCredentialsKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal("error generating credentials cache key: ", err)
+	}
+	return key
+}
+
+func currentCredentialsKey() []byte {
+	return credentialsKey.Load().([]byte)
+}
+
+func credentialsHMAC(key []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// passwordVerifier stands in for the sha1 password hash of account, it is only any use to who has key
+func passwordVerifier(key []byte, account string, passwordHash string) string {
+	return credentialsHMAC(key, "password", account, passwordHash)
+}
+
+func credentialsOf(user User) credentials {
+	key := currentCredentialsKey()
+	return credentials{
+		id:          user.Id,
+		verifier:    passwordVerifier(key, user.Account, user.PasswordHash),
+		status:      user.Status,
+		totpEnabled: user.TotpEnabled,
+		key:         key,
+	}
+}
+
+func (c credentials) passwordMatches(account string, password string) bool {
+	return hmac.Equal([]byte(c.verifier), []byte(passwordVerifier(c.key, account, hashSHA256(password))))
+}
+
+func cachingCredentials() bool {
+	return useCache && *credentialCacheTTL > 0
+}
+
+// credentialsCacheKey names the cached credentials of account under the HMAC key
+func credentialsCacheKey(key []byte, account string) string {
+	return credentialsPrefix + credentialsHMAC(key, "account", account)
+}
+
+// cachedCredentials returns the cached credentials of account, ok is false on a miss, when the cache is off or redis unavailable
+func cachedCredentials(account string) (cached credentials, ok bool, err error) {
+	if !cachingCredentials() {
+		return credentials{}, false, nil
+	}
+	key := currentCredentialsKey()
+	values, err := redisDB.HGetAll(ctx, credentialsCacheKey(key, account)).Result()
+	if redisUnavailable(err) {
+		return credentials{}, false, nil
+	} else if err != nil || len(values) == 0 {
+		return credentials{}, false, err
+	}
+	cached = credentials{
+		verifier:    values["verifier"],
+		status:      values["status"],
+		totpEnabled: values["totpEnabled"] == "1",
+		key:         key,
+	}
+	if cached.id, err = strconv.Atoi(values["id"]); err != nil {
+		return credentials{}, false, err
+	}
+	return cached, true, nil
+}
+
+func cacheCredentials(account string, c credentials) error {
+	if !cachingCredentials() {
+		return nil
+	}
+	key := credentialsCacheKey(c.key, account)
+	_, err := redisDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "id", c.id, "verifier", c.verifier, "status", c.status, "totpEnabled", c.totpEnabled)
+		pipe.Expire(ctx, key, *credentialCacheTTL)
+		return nil
+	})
+	if redisUnavailable(err) {
+		return nil
+	}
+	return err
+}
+
+// uncacheCredentials drops the cached credentials of account on every server
+func uncacheCredentials(account string) error {
+	if !cachingCredentials() {
+		return nil
+	}
+	_, err := redisDB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipeUncacheCredentials(ctx, pipe, account)
+		return nil
+	})
+	if redisUnavailable(err) {
+		markStaleCredentials(account)
+		return nil
+	}
+	return err
+}
+
+// pipeUncacheCredentials adds dropping the cached credentials of account on every server to pipe
+func pipeUncacheCredentials(ctx context.Context, pipe redis.Pipeliner, account string) {
+	pipe.Del(ctx, credentialsCacheKey(currentCredentialsKey(), account))
+	pipe.Publish(ctx, credentialInvalidationChannel, account)
+}
+
+// listenForCredentialInvalidations drops the credentials other servers invalidate until the server stops
+func listenForCredentialInvalidations() {
+	invalidations := redisDB.Subscribe(ctx, credentialInvalidationChannel)
+	defer invalidations.Close()
+	for {
+		message, err := invalidations.Receive(ctx)
+		if err != nil {
+			// the connection is redone on the next Receive, anything published meanwhile is lost
+			log.Println("error receiving credential invalidations: ", err)
+			forgetCachedCredentials()
+			time.Sleep(time.Second)
+			continue
+		}
+		if invalidation, ok := message.(*redis.Message); ok {
+			err := redisDB.Del(ctx, credentialsCacheKey(currentCredentialsKey(), invalidation.Payload)).Err()
+			if redisUnavailable(err) {
+				markStaleCredentials(invalidation.Payload)
+			} else if err != nil {
+				log.Println("error dropping invalidated credentials: ", err)
+				forgetCachedCredentials()
+			}
+		} else if _, ok := message.(*redis.Subscription); ok {
+			// subscribed again after losing the connection
+			forgetCachedCredentials()
+		}
+	}
+}
+
+// forgetCachedCredentials stops using what this server cached when an invalidation may have been missed.
+// A key of its own is replaced, so the entries under it are never read again. Entries under the shared
+// key are deleted by whoever invalidates them, a missed message leaves nothing behind.
+func forgetCachedCredentials() {
+	if *credentialCacheKeyFile == "" {
+		credentialsKey.Store(newCredentialsKey())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+	"time"
+)
+
+/*
+Database selection, MySQL for deployments and an embedded SQLite file for local development and CI
+so the whole stack runs without any external service
+*/
+
+var (
+	dbDriver = flag.String("db-driver", "mysql", "database to use, mysql or sqlite")
+	dbDSN    = flag.String("db-dsn", "", "data source name, defaults to the local MySQL from the README or entrytask.db for sqlite")
+)
+
+// defaultDSNs are used when -db-dsn is empty, MySQL needs clientFoundRows=true so updates that
+// change nothing still count as matching the user
+var defaultDSNs = map[string]string{
+	"mysql":  "root:secret@tcp(localhost:3306)/db?clientFoundRows=true",
+	"sqlite": "file:entrytask.db?_busy_timeout=5000&_journal_mode=WAL",
+}
+
+// openDB opens the primary database from -db-driver and -db-dsn
+func openDB() (*sql.DB, error) {
+	dsn := *dbDSN
+	if dsn == "" {
+		dsn = defaultDSNs[*dbDriver]
+	}
+	return openDSN(dsn)
+}
+
+// openDSN opens a database of the -db-driver kind, the primary or a replica
+func openDSN(dsn string) (*sql.DB, error) {
+	var driverName string
+	switch *dbDriver {
+	case "mysql":
+		driverName = "mysql"
+	case "sqlite":
+		driverName = "sqlite3"
+	default:
+		return nil, fmt.Errorf("unknown -db-driver %q, expected mysql or sqlite", *dbDriver)
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if *dbDriver == "sqlite" {
+		// SQLite only allows one writer at a time, so serialise everything through one connection
+		// instead of failing with SQLITE_BUSY under load
+		db.SetMaxOpenConns(1)
+	}
+	return db, nil
+}
+
+// dbNow is the time written to DATETIME columns, always UTC and to the millisecond MySQL keeps
+func dbNow() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// dbTime scans DATETIME columns from either driver, MySQL hands them over as text
+// unless the DSN has parseTime=true while SQLite already parses them
+type dbTime struct {
+	time.Time
+}
+
+func (t *dbTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case time.Time:
+		t.Time = v.UTC()
+		return nil
+	case []byte:
+		return t.parse(string(v))
+	case string:
+		return t.parse(v)
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into a time", value)
+}
+
+func (t *dbTime) parse(value string) error {
+	parsed, err := time.ParseInLocation("2006-01-02 15:04:05.999999999", value, time.UTC)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+The drop-legacy-cache subcommand deletes the profiles versions before profile:v1 cached in redis, which never
+expire and hold the password hash. Those are hashes named after the bare account, so only the accounts in the
+users table are looked at, a batch of them per pipeline, and only hashes with both the id and password fields
+are deleted. Run it once after upgrading from such a version.
+
+	go run ./app/tcp -- drop-legacy-cache
+*/
+
+func parseDropLegacyOptions(args []string) (batch int, err error) {
+	flags := flag.NewFlagSet("drop-legacy-cache", flag.ContinueOnError)
+	flags.IntVar(&batch, "batch", 1000, "accounts checked per pipeline")
+	if err := flags.Parse(args); err != nil {
+		return 0, err
+	}
+	if batch < 1 {
+		return 0, errors.New("-batch has to be at least 1")
+	}
+	return batch, nil
+}
+
+// runDropLegacyCommand handles the drop-legacy-cache subcommand, args are what follows "drop-legacy-cache"
+func runDropLegacyCommand(ctx context.Context, db *sql.DB, args []string) error {
+	batch, err := parseDropLegacyOptions(args)
+	if err != nil {
+		return err
+	}
+	client, err := newRedisClient()
+	if err != nil {
+		return err
+	}
+	if err := client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("connecting to redis: %w", err)
+	}
+	defer client.Close()
+
+	checked, dropped, lastId := 0, 0, 0
+	for {
+		accounts, last, err := readAccounts(ctx, db, lastId, batch)
+		if err != nil {
+			return err
+		} else if len(accounts) == 0 {
+			break
+		}
+		n, err := dropLegacyProfiles(ctx, client, accounts)
+		if err != nil {
+			return err
+		}
+		checked += len(accounts)
+		dropped += n
+		lastId = last
+	}
+	fmt.Printf("checked %d accounts, dropped %d profiles cached by an older version\n", checked, dropped)
+	return nil
+}
+
+// readAccounts reads up to n accounts by id after afterId, and the id of the last one
+func readAccounts(ctx context.Context, db *sql.DB, afterId int, n int) (accounts []string, lastId int, err error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, account FROM users WHERE id>? ORDER BY id LIMIT ?", afterId, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var account string
+		if err := rows.Scan(&lastId, &account); err != nil {
+			return nil, 0, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, lastId, rows.Err()
+}
+
+// dropLegacyProfiles deletes the legacy profiles cached under accounts and returns how many there were
+func dropLegacyProfiles(ctx context.Context, client redis.UniversalClient, accounts []string) (int, error) {
+	pipe := client.Pipeline()
+	fields := make([]*redis.SliceCmd, len(accounts))
+	for i, account := range accounts {
+		fields[i] = pipe.HMGet(ctx, account, "id", "password")
+	}
+	// keys that are not hashes fail with an error reply, and are left alone like hashes that are not profiles
+	var reply redis.Error
+	if _, err := pipe.Exec(ctx); err != nil && !errors.As(err, &reply) {
+		return 0, err
+	}
+
+	pipe = client.Pipeline()
+	dropped := 0
+	for i, account := range accounts {
+		values, err := fields[i].Result()
+		if err != nil || values[0] == nil || values[1] == nil {
+			continue
+		}
+		pipe.Del(ctx, account)
+		dropped++
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return dropped, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+)
+
+/*
+Metrics of the TCP server, served as JSON by expvar on -metrics-addr at /metrics (and /debug/vars)
+*/
+
+var metricsAddr = flag.String("metrics-addr", "localhost:9002", "address to serve metrics on, empty to turn them off")
+
+// publishDBStats exposes the connection pool statistics of db under name
+func publishDBStats(name string, db *sql.DB) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return db.Stats()
+	}))
+}
+
+func serveMetrics() {
+	if *metricsAddr == "" {
+		return
+	}
+	publishDBStats("db", db)
+	publishReplicaStats()
+	http.Handle("/metrics", expvar.Handler())
+	err := http.ListenAndServe(*metricsAddr, nil)
+	if err != nil {
+		log.Println("error serving metrics: ", err)
+	}
+}
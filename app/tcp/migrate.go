@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Versioned schema migrations, embedded from migrations/<driver>/ as NNNN_name.up.sql and NNNN_name.down.sql.
+Every driver has the same numbered migrations written in its own SQL dialect.
+The applied versions are tracked in schema_migrations. Run them with
+
+	go run ./app/tcp -- migrate status
+	go run ./app/tcp -- migrate up
+	go run ./app/tcp -- migrate down
+	go run ./app/tcp -- migrate to 1
+*/
+
+//go:embed migrations/mysql/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// loadMigrations reads the embedded migrations of -db-driver sorted by version
+func loadMigrations() ([]migration, error) {
+	dir := "migrations/" + *dbDriver
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for driver %s: %w", *dbDriver, err)
+	}
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("badly named migration %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		contents, err := migrationFiles.ReadFile(dir + "/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		} else if m.name != match[2] {
+			return nil, fmt.Errorf("two migrations numbered %d: %s and %s", version, m.name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(contents)
+		} else {
+			m.down = string(contents)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// splitStatements splits a migration into statements on the semicolons outside of quotes and comments
+func splitStatements(script string) []string {
+	var statements []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '#' || (c == '-' && strings.HasPrefix(script[i:], "-- ")):
+			if end := strings.IndexByte(script[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(script)
+			}
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			if end := strings.Index(script[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(script)
+			}
+		case c == ';':
+			statements = append(statements, script[start:i])
+			start = i + 1
+		}
+	}
+	statements = append(statements, script[start:])
+
+	var nonEmpty []string
+	for _, statement := range statements {
+		if strings.TrimSpace(stripComments(statement)) != "" {
+			nonEmpty = append(nonEmpty, strings.TrimSpace(statement))
+		}
+	}
+	return nonEmpty
+}
+
+// stripComments is only used to tell whether a statement is nothing but comments
+func stripComments(statement string) string {
+	var lines []string
+	for _, line := range strings.Split(statement, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "--") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func ensureMigrationsTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version    INT NOT NULL PRIMARY KEY,
+    name       VARCHAR(256) NOT NULL,
+    applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`)
+	return err
+}
+
+// appliedVersions returns the versions recorded in schema_migrations
+func appliedVersions(ctx context.Context, db *sql.DB) (map[int]bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+func currentVersion(applied map[int]bool) int {
+	current := 0
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current
+}
+
+// runMigration applies one direction of a migration and records it in schema_migrations.
+// MySQL commits DDL straight away, so a failure part way through a migration has to be fixed by hand,
+// SQLite rolls the whole migration back.
+func runMigration(ctx context.Context, db *sql.DB, m migration, up bool) error {
+	script, record, direction := m.up, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", "up"
+	args := []interface{}{m.version, m.name}
+	if !up {
+		if m.down == "" {
+			return fmt.Errorf("migration %d_%s cannot be undone, it has no down file", m.version, m.name)
+		}
+		script, record, direction = m.down, "DELETE FROM schema_migrations WHERE version=?", "down"
+		args = args[:1]
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, statement := range splitStatements(script) {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d_%s %s: %w", m.version, m.name, direction, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("migrated %s %d_%s\n", direction, m.version, m.name)
+	return nil
+}
+
+// migrateTo applies or undoes migrations until target is the latest applied version
+func migrateTo(ctx context.Context, db *sql.DB, target int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return err
+	}
+	applied, err := appliedVersions(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= target && !applied[m.version] {
+			if err := runMigration(ctx, db, m, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > target && applied[m.version] {
+			if err := runMigration(ctx, db, m, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func latestMigration() (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil || len(migrations) == 0 {
+		return 0, err
+	}
+	return migrations[len(migrations)-1].version, nil
+}
+
+func printMigrationStatus(ctx context.Context, db *sql.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return err
+	}
+	applied, err := appliedVersions(ctx, db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("current version: %d\n", currentVersion(applied))
+	for _, m := range migrations {
+		state := "pending"
+		if applied[m.version] {
+			state = "applied"
+		}
+		fmt.Printf("%04d %-30s %s\n", m.version, m.name, state)
+	}
+	return nil
+}
+
+// runMigrateCommand handles the migrate subcommand, args are what follows "migrate"
+func runMigrateCommand(ctx context.Context, db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate status|up|down|to <version>")
+	}
+	switch args[0] {
+	case "status":
+		return printMigrationStatus(ctx, db)
+	case "up":
+		latest, err := latestMigration()
+		if err != nil {
+			return err
+		}
+		return migrateTo(ctx, db, latest)
+	case "down":
+		// undo only the latest applied migration
+		if err := ensureMigrationsTable(ctx, db); err != nil {
+			return err
+		}
+		applied, err := appliedVersions(ctx, db)
+		if err != nil {
+			return err
+		}
+		current := currentVersion(applied)
+		if current == 0 {
+			return nil
+		}
+		previous := 0
+		for version := range applied {
+			if version < current && version > previous {
+				previous = version
+			}
+		}
+		return migrateTo(ctx, db, previous)
+	case "to":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: migrate to <version>")
+		}
+		target, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("bad version %q: %w", args[1], err)
+		}
+		return migrateTo(ctx, db, target)
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected status, up, down or to", args[0])
+	}
+}
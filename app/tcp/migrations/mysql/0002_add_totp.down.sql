@@ -0,0 +1,4 @@
+ALTER TABLE users
+    DROP COLUMN totpSecret,
+    DROP COLUMN totpEnabled,
+    DROP COLUMN totpRecoveryCodes;
@@ -0,0 +1,4 @@
+ALTER TABLE users
+    ADD COLUMN totpSecret        VARCHAR(64) NOT NULL DEFAULT '',       # base32 TOTP secret, set once enrollment starts
+    ADD COLUMN totpEnabled       TINYINT(1) NOT NULL DEFAULT 0,         # only on once the first code was confirmed
+    ADD COLUMN totpRecoveryCodes VARCHAR(1024) NOT NULL DEFAULT '';     # comma separated sha1 hashes of unused recovery codes
@@ -0,0 +1,2 @@
+ALTER TABLE users
+    ADD COLUMN version INT NOT NULL DEFAULT 1;      # bumped on every nickname or picture update, for optimistic locking
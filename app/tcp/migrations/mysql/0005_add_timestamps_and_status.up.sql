@@ -0,0 +1,5 @@
+ALTER TABLE users
+    ADD COLUMN created_at    DATETIME(3) NULL,                      # UTC, null for users from before it was kept
+    ADD COLUMN updated_at    DATETIME(3) NULL,                      # UTC, last profile, two-factor or status change
+    ADD COLUMN last_login_at DATETIME(3) NULL,                      # UTC, null until the next successful login
+    ADD COLUMN status        VARCHAR(16) NOT NULL DEFAULT 'active'; # active, disabled or deleted
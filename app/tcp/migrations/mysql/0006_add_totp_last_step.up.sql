@@ -0,0 +1,2 @@
+ALTER TABLE users
+    ADD COLUMN totpLastStep BIGINT NOT NULL DEFAULT 0;     # time step of the last accepted TOTP code, so it cannot be sent again
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS users
+(
+    id                  INTEGER PRIMARY KEY AUTOINCREMENT,      -- Unique User ID
+    account             VARCHAR(256) NOT NULL UNIQUE,           -- Account of the User
+    nickname            VARCHAR(256) DEFAULT '',                -- Nickname of the User
+    password            VARCHAR(256) NOT NULL,                  -- Password of the User
+    pictureFileName     VARCHAR(1024) DEFAULT ''                -- path to the file in the HTTP server
+);
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN totpSecret;
+ALTER TABLE users DROP COLUMN totpEnabled;
+ALTER TABLE users DROP COLUMN totpRecoveryCodes;
@@ -0,0 +1,6 @@
+-- base32 TOTP secret, set once enrollment starts
+ALTER TABLE users ADD COLUMN totpSecret VARCHAR(64) NOT NULL DEFAULT '';
+-- only on once the first code was confirmed
+ALTER TABLE users ADD COLUMN totpEnabled TINYINT(1) NOT NULL DEFAULT 0;
+-- comma separated sha1 hashes of unused recovery codes
+ALTER TABLE users ADD COLUMN totpRecoveryCodes VARCHAR(1024) NOT NULL DEFAULT '';
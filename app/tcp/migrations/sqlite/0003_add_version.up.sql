@@ -0,0 +1,2 @@
+-- bumped on every nickname or picture update, for optimistic locking
+ALTER TABLE users ADD COLUMN version INT NOT NULL DEFAULT 1;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS audit_events
+(
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at  DATETIME NOT NULL,                        -- UTC
+    account     VARCHAR(256) NOT NULL,                    -- account the event happened to
+    actor       VARCHAR(256) NOT NULL DEFAULT '',         -- admin who did it, empty when it was the user
+    event       VARCHAR(64) NOT NULL,                     -- login_success, nickname_changed, ...
+    ip          VARCHAR(64) NOT NULL DEFAULT '',          -- client address, only known for logins
+    old_value   VARCHAR(1024) NOT NULL DEFAULT '',
+    new_value   VARCHAR(1024) NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS audit_events_account_created_at ON audit_events (account, created_at);
+CREATE INDEX IF NOT EXISTS audit_events_created_at ON audit_events (created_at);
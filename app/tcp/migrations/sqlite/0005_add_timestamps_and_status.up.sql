@@ -0,0 +1,8 @@
+-- UTC, null for users from before it was kept
+ALTER TABLE users ADD COLUMN created_at DATETIME NULL;
+-- UTC, last profile, two-factor or status change
+ALTER TABLE users ADD COLUMN updated_at DATETIME NULL;
+-- UTC, null until the next successful login
+ALTER TABLE users ADD COLUMN last_login_at DATETIME NULL;
+-- active, disabled or deleted
+ALTER TABLE users ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'active';
@@ -0,0 +1,2 @@
+-- time step of the last accepted TOTP code, so it cannot be sent again
+ALTER TABLE users ADD COLUMN totpLastStep INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"github.com/go-redis/redis/v8"
+	"sync"
+	"time"
+)
+
+/*
+Throttling of failed logins, counted per account and per client IP.
+Once either counter reaches -login-max-failures the key is locked out, and every further failure
+doubles the lockout up to -login-max-lockout. A successful login clears the account counter
+but not the IP one, so an attacker cannot reset it by logging into their own account.
+Redis is used when the cache is turned on, otherwise the counters are kept in memory, as they are while redis is unavailable.
+*/
+
+const (
+	loginFailPrefix = "loginfail:"
+	loginLockPrefix = "loginlock:"
+)
+
+var (
+	maxLoginFailures   = flag.Int("login-max-failures", 5, "failed logins per account or IP before locking it out")
+	loginFailureWindow = flag.Duration("login-failure-window", 15*time.Minute, "how long failed logins are remembered")
+	loginLockout       = flag.Duration("login-lockout", 30*time.Second, "first lockout, doubled for every further failure")
+	maxLoginLockout    = flag.Duration("login-max-lockout", 15*time.Minute, "longest lockout")
+)
+
+// memoryLimiter is the fallback used when the server runs without redis, or redis is unavailable
+type memoryLimiter struct {
+	mu       sync.Mutex
+	attempts map[string]*failedAttempts
+}
+
+type failedAttempts struct {
+	count       int
+	forgetAt    time.Time
+	lockedUntil time.Time
+}
+
+var limiter = &memoryLimiter{
+	attempts: make(map[string]*failedAttempts),
+}
+
+func accountLimitKey(account string) string {
+	return "account:" + account
+}
+
+func ipLimitKey(ip string) string {
+	return "ip:" + ip
+}
+
+// lockoutFor returns how long a key is locked out after count failures
+func lockoutFor(count int) time.Duration {
+	if count < *maxLoginFailures {
+		return 0
+	}
+	lockout := *loginLockout
+	for i := *maxLoginFailures; i < count && lockout < *maxLoginLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > *maxLoginLockout {
+		lockout = *maxLoginLockout
+	}
+	return lockout
+}
+
+// loginLockedFor returns how much longer any of the keys is locked out, 0 if none are
+func loginLockedFor(keys ...string) (time.Duration, error) {
+	var longest time.Duration
+	// lockouts from while redis was unavailable are kept in memory too
+	limiter.mu.Lock()
+	now := time.Now()
+	for _, key := range keys {
+		if a, ok := limiter.attempts[key]; ok && now.Before(a.lockedUntil) {
+			if remaining := a.lockedUntil.Sub(now); remaining > longest {
+				longest = remaining
+			}
+		}
+	}
+	limiter.mu.Unlock()
+
+	if useCache {
+		for _, key := range keys {
+			ttl, err := redisDB.PTTL(ctx, loginLockPrefix+key).Result()
+			if redisUnavailable(err) {
+				return longest, nil
+			} else if err != nil {
+				return 0, err
+			}
+			// negative ttl means there is no lock
+			if ttl > longest {
+				longest = ttl
+			}
+		}
+	}
+	return longest, nil
+}
+
+// recordLoginFailure counts a failed login against every key and locks out those over the limit
+func recordLoginFailure(keys ...string) error {
+	if useCache {
+		err := recordLoginFailureInRedis(keys...)
+		if !redisUnavailable(err) {
+			return err
+		}
+		// counted in memory until redis is back
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		a, ok := limiter.attempts[key]
+		if !ok || now.After(a.forgetAt) {
+			a = &failedAttempts{forgetAt: now.Add(*loginFailureWindow)}
+			limiter.attempts[key] = a
+		}
+		a.count++
+		if lockout := lockoutFor(a.count); lockout > 0 {
+			a.lockedUntil = now.Add(lockout)
+		}
+	}
+	return nil
+}
+
+func recordLoginFailureInRedis(keys ...string) error {
+	for _, key := range keys {
+		// the counter is created with its expiry in the same transaction, so it cannot be left without one
+		var incr *redis.IntCmd
+		_, err := redisDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetNX(ctx, loginFailPrefix+key, 0, *loginFailureWindow)
+			incr = pipe.Incr(ctx, loginFailPrefix+key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		count := incr.Val()
+		if lockout := lockoutFor(int(count)); lockout > 0 {
+			if err := redisDB.Set(ctx, loginLockPrefix+key, count, lockout).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resetLoginFailures forgets the failures of the keys after a successful login
+func resetLoginFailures(keys ...string) error {
+	limiter.mu.Lock()
+	for _, key := range keys {
+		delete(limiter.attempts, key)
+	}
+	limiter.mu.Unlock()
+
+	if useCache {
+		pipe := redisDB.Pipeline()
+		for _, key := range keys {
+			pipe.Del(ctx, loginFailPrefix+key)
+			pipe.Del(ctx, loginLockPrefix+key)
+		}
+		_, err := pipe.Exec(ctx)
+		if err != nil && !redisUnavailable(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeLimiter drops forgotten entries from the in-memory limiter so it does not grow forever
+func purgeLimiter() {
+	for range time.Tick(time.Minute) {
+		limiter.mu.Lock()
+		now := time.Now()
+		for key, a := range limiter.attempts {
+			if now.After(a.forgetAt) && now.After(a.lockedUntil) {
+				delete(limiter.attempts, key)
+			}
+		}
+		limiter.mu.Unlock()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// setThrottle changes the login throttling flags for the test and forgets the failures kept in memory
+func setThrottle(t *testing.T, maxFailures int, lockout time.Duration, maxLockout time.Duration) {
+	oldMax, oldLockout, oldMaxLockout := *maxLoginFailures, *loginLockout, *maxLoginLockout
+	*maxLoginFailures, *loginLockout, *maxLoginLockout = maxFailures, lockout, maxLockout
+	limiter.mu.Lock()
+	limiter.attempts = make(map[string]*failedAttempts)
+	limiter.mu.Unlock()
+	t.Cleanup(func() {
+		*maxLoginFailures, *loginLockout, *maxLoginLockout = oldMax, oldLockout, oldMaxLockout
+	})
+}
+
+func TestLockoutFor(t *testing.T) {
+	setThrottle(t, 3, time.Second, 5*time.Second)
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 5 * time.Second},
+		{100, 5 * time.Second},
+	}
+	for _, test := range tests {
+		if got := lockoutFor(test.failures); got != test.want {
+			t.Errorf("lockoutFor(%d) = %s, want %s", test.failures, got, test.want)
+		}
+	}
+}
+
+// TestThrottleLockAndUnlock locks a key out, waits for the lockout to pass, locks it out longer and resets it
+func TestThrottleLockAndUnlock(t *testing.T) {
+	const lockout = 50 * time.Millisecond
+	backends := []struct {
+		name string
+		use  func(t *testing.T)
+	}{
+		{"memory", func(t *testing.T) {
+			oldUseCache := useCache
+			useCache = false
+			t.Cleanup(func() {
+				useCache = oldUseCache
+			})
+		}},
+		{"redis", func(t *testing.T) {
+			useFakeRedis(t)
+		}},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			setThrottle(t, 3, lockout, time.Second)
+			backend.use(t)
+			key := accountLimitKey("alice")
+			lockedFor := func() time.Duration {
+				t.Helper()
+				locked, err := loginLockedFor(key, ipLimitKey("1.1.1.1"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return locked
+			}
+			fail := func() {
+				t.Helper()
+				if err := recordLoginFailure(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			fail()
+			fail()
+			if locked := lockedFor(); locked != 0 {
+				t.Fatalf("locked out for %s after 2 failures", locked)
+			}
+			fail()
+			if locked := lockedFor(); locked <= 0 || locked > lockout {
+				t.Fatalf("locked out for %s after 3 failures, want up to %s", locked, lockout)
+			}
+			time.Sleep(lockout + 10*time.Millisecond)
+			if locked := lockedFor(); locked != 0 {
+				t.Fatalf("still locked out for %s after the lockout", locked)
+			}
+			fail()
+			if locked := lockedFor(); locked <= lockout || locked > 2*lockout {
+				t.Fatalf("locked out for %s after 4 failures, want twice %s", locked, lockout)
+			}
+			if err := resetLoginFailures(key); err != nil {
+				t.Fatal(err)
+			}
+			if locked := lockedFor(); locked != 0 {
+				t.Fatalf("locked out for %s after a reset", locked)
+			}
+			fail()
+			if locked := lockedFor(); locked != 0 {
+				t.Errorf("locked out for %s by the first failure after a reset", locked)
+			}
+		})
+	}
+}
+
+// TestLoginFailureCounterExpires checks every failure counter in redis is given the window as expiry, and keeps it
+func TestLoginFailureCounterExpires(t *testing.T) {
+	setThrottle(t, 3, time.Minute, time.Hour)
+	fake := useFakeRedis(t)
+	keys := []string{accountLimitKey("alice"), ipLimitKey("1.1.1.1")}
+	for i := 0; i < 5; i++ {
+		if err := recordLoginFailure(keys...); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			ttl := fake.ttl(loginFailPrefix + key)
+			if ttl <= *loginFailureWindow-time.Second || ttl > *loginFailureWindow {
+				t.Fatalf("failure %d: %s expires in %s, want the %s window from the first failure", i+1, key, ttl, *loginFailureWindow)
+			}
+		}
+	}
+
+	// the counter is only ever created together with its expiry
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for i, command := range fake.commands {
+		if !strings.HasPrefix(command, "incr ") {
+			continue
+		}
+		key := strings.TrimPrefix(command, "incr ")
+		if i < 2 || fake.commands[i-2] != "multi" || !strings.HasPrefix(fake.commands[i-1], "set "+key+" 0 ex ") {
+			t.Fatalf("%q not sent in a transaction after setting its expiry: %q", command, fake.commands)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"os"
+	"strings"
+)
+
+/*
+Connection to redis, which -redis-mode picks how to reach so the cache tier can be deployed highly available:
+
+	single    the one redis at -redis-addrs
+	sentinel  the master the sentinels at -redis-addrs know as -redis-master, followed to its replica on failover
+	cluster   a redis cluster, -redis-addrs lists some of its nodes
+
+Every key lives in a single slot, and commands touching several keys only ever go through pipelines, which
+the cluster client splits by node. Keyspace notifications are per node, see forEachNode.
+The cluster client sends everything, Watch and the commands of forEachNode included, through a client per
+node, so redisBreaker is added to every node client rather than to the cluster client. Pub/sub goes around
+hooks in every mode, its listeners redo the subscription on any error instead.
+*/
+
+var (
+	redisMode             = flag.String("redis-mode", "single", "how redis is deployed: single, sentinel or cluster")
+	redisAddrs            = flag.String("redis-addrs", "localhost:6379", "comma separated host:port of the redis, of the sentinels or of some cluster nodes")
+	redisMaster           = flag.String("redis-master", "", "name of the master the sentinels watch, for -redis-mode=sentinel")
+	redisUsername         = flag.String("redis-username", "", "redis ACL user, empty for the default user")
+	redisPassword         = flag.String("redis-password", "", "redis password")
+	redisSentinelPassword = flag.String("redis-sentinel-password", "", "password of the sentinels, if they have one")
+	redisDatabase         = flag.Int("redis-db", 0, "redis database number, a cluster only has 0")
+	redisTLS              = flag.Bool("redis-tls", false, "connect to redis over TLS")
+	redisTLSCA            = flag.String("redis-tls-ca", "", "PEM file of the CA of the redis certificates, the system CAs when empty")
+	redisTLSServerName    = flag.String("redis-tls-server-name", "", "name the redis certificates are checked against, the host of each address when empty")
+)
+
+const (
+	RedisSingle   = "single"
+	RedisSentinel = "sentinel"
+	RedisCluster  = "cluster"
+)
+
+// newRedisClient makes the client of the redis the flags describe, guarded by redisBreaker
+func newRedisClient() (redis.UniversalClient, error) {
+	options := &redis.UniversalOptions{
+		Addrs:            strings.Split(*redisAddrs, ","),
+		DB:               *redisDatabase,
+		Username:         *redisUsername,
+		Password:         *redisPassword,
+		SentinelPassword: *redisSentinelPassword,
+	}
+	if *redisTLS {
+		config, err := redisTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		options.TLSConfig = config
+	}
+
+	var client redis.UniversalClient
+	if *redisMode == RedisSingle {
+		if len(options.Addrs) != 1 {
+			return nil, errors.New("-redis-mode=single takes one address in -redis-addrs")
+		}
+		client = redis.NewClient(options.Simple())
+	} else if *redisMode == RedisSentinel {
+		if *redisMaster == "" {
+			return nil, errors.New("-redis-mode=sentinel needs -redis-master")
+		}
+		options.MasterName = *redisMaster
+		client = redis.NewFailoverClient(options.Failover())
+	} else if *redisMode == RedisCluster {
+		if *redisDatabase != 0 {
+			return nil, errors.New("a redis cluster only has -redis-db=0")
+		}
+		clusterOptions := options.Cluster()
+		clusterOptions.NewClient = func(opt *redis.Options) *redis.Client {
+			node := redis.NewClient(opt)
+			node.AddHook(redisBreaker)
+			return node
+		}
+		client = redis.NewClusterClient(clusterOptions)
+	} else {
+		return nil, fmt.Errorf("unknown -redis-mode %q, expected single, sentinel or cluster", *redisMode)
+	}
+	if _, ok := client.(*redis.ClusterClient); !ok {
+		// the nodes of a cluster have it already, on both it would count every command twice
+		client.AddHook(redisBreaker)
+	}
+	redisBreaker.client = client
+	return client, nil
+}
+
+func redisTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: *redisTLSServerName,
+	}
+	if *redisTLSCA != "" {
+		pem, err := os.ReadFile(*redisTLSCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *redisTLSCA)
+		}
+	}
+	return config, nil
+}
+
+// forEachNode calls fn with every master of a cluster at once, or with client when it is not a cluster,
+// for what a node only does with its own keys
+func forEachNode(client redis.UniversalClient, fn func(node redis.UniversalClient)) error {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		fn(client)
+		return nil
+	}
+	return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		fn(node)
+		return nil
+	})
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+fakeRedis is a redis with the few commands the tests send, answering over net.Pipe connections while it is up
+and closing them while it is down. Strings with an expiry, hashes, and MULTI/EXEC are kept, publishing reaches
+nobody and any other command is answered with OK.
+*/
+type fakeRedis struct {
+	up    int32
+	dials int32
+
+	mu       sync.Mutex
+	commands []string
+	entries  map[string]*fakeEntry
+}
+
+type fakeEntry struct {
+	value   string
+	hash    map[string]string // nil for a string
+	expires time.Time         // zero for none
+}
+
+const (
+	nilReply       = "$-1\r\n"
+	wrongTypeReply = "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+)
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{up: 1, entries: make(map[string]*fakeEntry)}
+}
+
+// useFakeRedis has the server cache in a new fakeRedis for the test
+func useFakeRedis(t *testing.T) *fakeRedis {
+	fake := newFakeRedis()
+	client := redis.NewClient(&redis.Options{Dialer: fake.dial, MaxRetries: -1})
+	oldRedis, oldUseCache := redisDB, useCache
+	redisDB, useCache = client, true
+	t.Cleanup(func() {
+		client.Close()
+		redisDB, useCache = oldRedis, oldUseCache
+	})
+	return fake
+}
+
+func (f *fakeRedis) setUp(up bool) {
+	if up {
+		atomic.StoreInt32(&f.up, 1)
+	} else {
+		atomic.StoreInt32(&f.up, 0)
+	}
+}
+
+func (f *fakeRedis) isUp() bool {
+	return atomic.LoadInt32(&f.up) == 1
+}
+
+func (f *fakeRedis) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	atomic.AddInt32(&f.dials, 1)
+	if !f.isUp() {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	client, server := net.Pipe()
+	go f.serve(server)
+	return client, nil
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		command, err := readCommand(reader)
+		if err != nil || !f.isUp() {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, strings.Join(command, " "))
+		f.mu.Unlock()
+		var reply string
+		switch name := strings.ToUpper(command[0]); {
+		case name == "MULTI":
+			inMulti, queued = true, nil
+			reply = "+OK\r\n"
+		case name == "EXEC":
+			reply = fmt.Sprintf("*%d\r\n", len(queued))
+			for _, c := range queued {
+				reply += f.do(c)
+			}
+			inMulti, queued = false, nil
+		case inMulti:
+			queued = append(queued, command)
+			reply = "+QUEUED\r\n"
+		default:
+			reply = f.do(command)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads a command, an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+	command := make([]string, n)
+	for i := range command {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("bad argument %q", line)
+		}
+		argument := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, argument); err != nil {
+			return nil, err
+		}
+		command[i] = string(argument[:size])
+	}
+	return command, nil
+}
+
+func bulkReply(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func intReply(n int64) string {
+	return fmt.Sprintf(":%d\r\n", n)
+}
+
+// entry returns the live entry of key, dropping it once expired, f.mu is held
+func (f *fakeRedis) entry(key string) *fakeEntry {
+	e, ok := f.entries[key]
+	if !ok {
+		return nil
+	}
+	if !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(f.entries, key)
+		return nil
+	}
+	return e
+}
+
+// do runs command and returns its reply
+func (f *fakeRedis) do(command []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	args := command[1:]
+	switch strings.ToUpper(command[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "PUBLISH":
+		return ":0\r\n"
+	case "GET":
+		e := f.entry(args[0])
+		if e == nil {
+			return nilReply
+		} else if e.hash != nil {
+			return wrongTypeReply
+		}
+		return bulkReply(e.value)
+	case "SET":
+		e := &fakeEntry{value: args[1]}
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if f.entry(args[0]) != nil {
+					return nilReply
+				}
+			case "EX", "PX":
+				n, _ := strconv.ParseInt(args[i+1], 10, 64)
+				unit := time.Second
+				if strings.ToUpper(args[i]) == "PX" {
+					unit = time.Millisecond
+				}
+				e.expires = time.Now().Add(time.Duration(n) * unit)
+				i++
+			}
+		}
+		f.entries[args[0]] = e
+		return "+OK\r\n"
+	case "INCR":
+		e := f.entry(args[0])
+		if e == nil {
+			e = &fakeEntry{value: "0"}
+			f.entries[args[0]] = e
+		} else if e.hash != nil {
+			return wrongTypeReply
+		}
+		n, err := strconv.ParseInt(e.value, 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		e.value = strconv.FormatInt(n+1, 10)
+		return intReply(n + 1)
+	case "EXPIRE":
+		e := f.entry(args[0])
+		if e == nil {
+			return ":0\r\n"
+		}
+		seconds, _ := strconv.ParseInt(args[1], 10, 64)
+		e.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+		return ":1\r\n"
+	case "PTTL":
+		e := f.entry(args[0])
+		if e == nil {
+			return ":-2\r\n"
+		} else if e.expires.IsZero() {
+			return ":-1\r\n"
+		}
+		return intReply(time.Until(e.expires).Milliseconds())
+	case "DEL", "EXISTS":
+		n := int64(0)
+		for _, key := range args {
+			if f.entry(key) != nil {
+				n++
+				if strings.ToUpper(command[0]) == "DEL" {
+					delete(f.entries, key)
+				}
+			}
+		}
+		return intReply(n)
+	case "HSET":
+		e := f.entry(args[0])
+		if e == nil {
+			e = &fakeEntry{hash: make(map[string]string)}
+			f.entries[args[0]] = e
+		} else if e.hash == nil {
+			return wrongTypeReply
+		}
+		added := int64(0)
+		for i := 1; i+1 < len(args); i += 2 {
+			if _, ok := e.hash[args[i]]; !ok {
+				added++
+			}
+			e.hash[args[i]] = args[i+1]
+		}
+		return intReply(added)
+	case "HMGET":
+		e := f.entry(args[0])
+		if e != nil && e.hash == nil {
+			return wrongTypeReply
+		}
+		reply := fmt.Sprintf("*%d\r\n", len(args)-1)
+		for _, field := range args[1:] {
+			value, ok := "", false
+			if e != nil {
+				value, ok = e.hash[field]
+			}
+			if ok {
+				reply += bulkReply(value)
+			} else {
+				reply += nilReply
+			}
+		}
+		return reply
+	}
+	return "+OK\r\n"
+}
+
+// ttl returns the expiry left on key, -1 when it has none and -2 when it does not exist
+func (f *fakeRedis) ttl(key string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := f.entry(key)
+	if e == nil {
+		return -2
+	} else if e.expires.IsZero() {
+		return -1
+	}
+	return time.Until(e.expires)
+}
+
+func (f *fakeRedis) received(command string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Read replica routing. Profile and login reads go round robin to the healthy replicas listed in
+-db-replica-dsns, and to the primary when none is healthy or a replica query fails. Writes always
+go to the primary, and for -read-your-writes after a user is written their reads stay on the primary
+too, so they see their own change however far behind the replicas are. Reads that a security
+decision depends on, such as TOTP secrets and recovery codes, are sent to the primary with readFromPrimary.
+The pinning only covers writes made through this TCP server.
+*/
+
+var (
+	replicaDSNs           = flag.String("db-replica-dsns", "", "comma separated data source names of read replicas, empty to read from the primary")
+	replicaHealthInterval = flag.Duration("db-replica-health-interval", 5*time.Second, "how often replicas are pinged")
+	readYourWrites        = flag.Duration("read-your-writes", 5*time.Second, "how long reads of a user stay on the primary after it is written")
+)
+
+// replicas are the read replicas in -db-replica-dsns, empty when there are none
+var replicas []*replica
+
+type replica struct {
+	name    string // replica1, replica2, ... in the order of -db-replica-dsns, the DSN has the password in it
+	db      *sql.DB
+	healthy int32 // atomic, 1 when the last ping succeeded
+
+	mu    sync.Mutex
+	users *sqlUserRepository // prepared on the first successful ping, so a replica can start out down
+}
+
+func (r *replica) repository() *sqlUserRepository {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.users
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+// setHealthy records the state of the replica and logs when it changes
+func (r *replica) setHealthy(healthy bool, err error) {
+	var value int32
+	if healthy {
+		value = 1
+	}
+	if atomic.SwapInt32(&r.healthy, value) != value {
+		if healthy {
+			log.Println("replica back up: ", r.name)
+		} else {
+			log.Println("replica down: ", r.name, err)
+		}
+	}
+}
+
+func (r *replica) ping() {
+	pingCtx, cancel := context.WithTimeout(ctx, *replicaHealthInterval)
+	defer cancel()
+	err := r.db.PingContext(pingCtx)
+	if err == nil && r.repository() == nil {
+		var users *sqlUserRepository
+		users, err = newSQLUserRepository(pingCtx, r.db, *dbDriver)
+		if err == nil {
+			r.mu.Lock()
+			r.users = users
+			r.mu.Unlock()
+		}
+	}
+	r.setHealthy(err == nil, err)
+}
+
+// openReplicas connects to every replica in -db-replica-dsns and pings them once,
+// a replica that is down is only skipped until a later ping succeeds
+func openReplicas() ([]*replica, error) {
+	var opened []*replica
+	for i, dsn := range strings.Split(*replicaDSNs, ",") {
+		dsn = strings.TrimSpace(dsn)
+		if dsn == "" {
+			continue
+		}
+		replicaDB, err := openDSN(dsn)
+		if err != nil {
+			closeReplicas(opened)
+			return nil, fmt.Errorf("replica%d: %w", i+1, err)
+		}
+		r := &replica{name: fmt.Sprintf("replica%d", i+1), db: replicaDB}
+		r.ping()
+		if !r.isHealthy() {
+			log.Println("replica down at start up, reads skip it until it answers: ", r.name)
+		}
+		opened = append(opened, r)
+	}
+	return opened, nil
+}
+
+func closeReplicas(toClose []*replica) {
+	for _, r := range toClose {
+		if users := r.repository(); users != nil {
+			users.Close()
+		}
+		if err := r.db.Close(); err != nil {
+			log.Println("error closing connection to replica: ", err)
+		}
+	}
+}
+
+// publishReplicaStats adds the pool stats of every replica and which of them are healthy to the metrics
+func publishReplicaStats() {
+	for _, r := range replicas {
+		publishDBStats("db_"+r.name, r.db)
+	}
+	expvar.Publish("db_replicas_healthy", expvar.Func(func() interface{} {
+		healthy := make(map[string]bool)
+		for _, r := range replicas {
+			healthy[r.name] = r.isHealthy()
+		}
+		return healthy
+	}))
+}
+
+type primaryContextKey struct{}
+
+// readFromPrimary marks ctx so the reads made with it skip the replicas
+func readFromPrimary(parent context.Context) context.Context {
+	return context.WithValue(parent, primaryContextKey{}, true)
+}
+
+func mustReadPrimary(ctx context.Context) bool {
+	primaryOnly, _ := ctx.Value(primaryContextKey{}).(bool)
+	return primaryOnly
+}
+
+// replicatedUserRepository is the UserRepository that writes to the primary and reads from the replicas
+type replicatedUserRepository struct {
+	primary  *sqlUserRepository
+	replicas []*replica
+	next     uint32 // atomic round robin counter
+
+	mu     sync.Mutex
+	pinned map[int]time.Time // user id to when its reads can go back to the replicas
+}
+
+func newReplicatedUserRepository(primary *sqlUserRepository, replicas []*replica) *replicatedUserRepository {
+	return &replicatedUserRepository{
+		primary:  primary,
+		replicas: replicas,
+		pinned:   make(map[int]time.Time),
+	}
+}
+
+// pickReplica returns the next healthy replica, nil when they are all down
+func (r *replicatedUserRepository) pickReplica() *replica {
+	for range r.replicas {
+		next := atomic.AddUint32(&r.next, 1)
+		candidate := r.replicas[int(next%uint32(len(r.replicas)))]
+		if candidate.isHealthy() {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// pin keeps the reads of a user on the primary for -read-your-writes
+func (r *replicatedUserRepository) pin(id int) {
+	r.mu.Lock()
+	r.pinned[id] = time.Now().Add(*readYourWrites)
+	r.mu.Unlock()
+}
+
+func (r *replicatedUserRepository) isPinned(id int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	until, ok := r.pinned[id]
+	return ok && time.Now().Before(until)
+}
+
+// read runs get against a replica unless ctx asks for the primary, going to the primary instead
+// when the replica fails or the user turns out to have been written moments ago
+func (r *replicatedUserRepository) read(ctx context.Context, get func(repo *sqlUserRepository) (User, error)) (User, error) {
+	if mustReadPrimary(ctx) {
+		return get(r.primary)
+	}
+	from := r.pickReplica()
+	if from == nil {
+		return get(r.primary)
+	}
+	user, err := get(from.repository())
+	if err != nil && err != ErrUserNotFound {
+		log.Println("error reading from ", from.name, ", reading from the primary instead: ", err)
+		from.setHealthy(false, err)
+		return get(r.primary)
+	}
+	if err == nil && r.isPinned(user.Id) {
+		// the replica may not have the latest write yet
+		return get(r.primary)
+	}
+	return user, err
+}
+
+func (r *replicatedUserRepository) GetByAccount(ctx context.Context, account string) (User, error) {
+	return r.read(ctx, func(repo *sqlUserRepository) (User, error) {
+		return repo.GetByAccount(ctx, account)
+	})
+}
+
+func (r *replicatedUserRepository) GetByID(ctx context.Context, id int) (User, error) {
+	if r.isPinned(id) {
+		return r.primary.GetByID(ctx, id)
+	}
+	return r.read(ctx, func(repo *sqlUserRepository) (User, error) {
+		return repo.GetByID(ctx, id)
+	})
+}
+
+// UpdateNickname and the other writes pin the user even when they fail, a conflict means someone else just wrote it
+func (r *replicatedUserRepository) UpdateNickname(ctx context.Context, id int, nickname string, expectedVersion int) (string, int, error) {
+	defer r.pin(id)
+	return r.primary.UpdateNickname(ctx, id, nickname, expectedVersion)
+}
+
+func (r *replicatedUserRepository) UpdatePicture(ctx context.Context, id int, fileName string, expectedVersion int) (string, int, error) {
+	defer r.pin(id)
+	return r.primary.UpdatePicture(ctx, id, fileName, expectedVersion)
+}
+
+func (r *replicatedUserRepository) UpdateTotp(ctx context.Context, id int, secret string, enabled bool, recoveryCodes string) error {
+	defer r.pin(id)
+	return r.primary.UpdateTotp(ctx, id, secret, enabled, recoveryCodes)
+}
+
+func (r *replicatedUserRepository) UseTotpStep(ctx context.Context, id int, step int64) error {
+	defer r.pin(id)
+	return r.primary.UseTotpStep(ctx, id, step)
+}
+
+func (r *replicatedUserRepository) ReplaceRecoveryCodes(ctx context.Context, id int, oldCodes string, newCodes string) error {
+	defer r.pin(id)
+	return r.primary.ReplaceRecoveryCodes(ctx, id, oldCodes, newCodes)
+}
+
+func (r *replicatedUserRepository) SetStatus(ctx context.Context, account string, status string) (int, string, error) {
+	id, oldStatus, err := r.primary.SetStatus(ctx, account, status)
+	if err == nil {
+		r.pin(id)
+	}
+	return id, oldStatus, err
+}
+
+// RecordLogin does not pin the user, nothing reads last_login_at straight after
+func (r *replicatedUserRepository) RecordLogin(ctx context.Context, id int, at time.Time) error {
+	return r.primary.RecordLogin(ctx, id, at)
+}
+
+func (r *replicatedUserRepository) Create(ctx context.Context, user User) (int, error) {
+	id, err := r.primary.Create(ctx, user)
+	if err == nil {
+		r.pin(id)
+	}
+	return id, err
+}
+
+// watchReplicas pings the replicas every -db-replica-health-interval and forgets expired pins
+func (r *replicatedUserRepository) watchReplicas() {
+	for range time.Tick(*replicaHealthInterval) {
+		for _, each := range r.replicas {
+			each.ping()
+		}
+		r.mu.Lock()
+		now := time.Now()
+		for id, until := range r.pinned {
+			if now.After(until) {
+				delete(r.pinned, id)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
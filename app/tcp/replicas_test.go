@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+newLaggingReplica returns a replicated repository over two sqlite databases that never catch up with each other,
+so a read shows which one it was served from. alice and bob are on both, with their nickname saying where.
+*/
+func newLaggingReplica(t *testing.T) (*replicatedUserRepository, *replica) {
+	primary, lagging := newSQLiteUsers(t), newSQLiteUsers(t)
+	for _, account := range []string{"alice", "bob"} {
+		if _, err := primary.Create(ctx, User{Account: account, Nickname: account + " on primary", PasswordHash: hashSHA256("secret")}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := lagging.Create(ctx, User{Account: account, Nickname: account + " on replica", PasswordHash: hashSHA256("secret")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &replica{name: "replica1", healthy: 1, users: lagging}
+	return newReplicatedUserRepository(primary, []*replica{r}), r
+}
+
+// nicknameOf reads account both by account and by id, which have to agree on where they read from
+func nicknameOf(t *testing.T, repo *replicatedUserRepository, account string) string {
+	t.Helper()
+	user, err := repo.GetByAccount(ctx, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byId, err := repo.GetByID(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byId.Nickname != user.Nickname {
+		t.Fatalf("%s read as %q by account and %q by id", account, user.Nickname, byId.Nickname)
+	}
+	return user.Nickname
+}
+
+// TestReadYourWrites has alice update her nickname, her reads stay on the primary for -read-your-writes and bob's do not
+func TestReadYourWrites(t *testing.T) {
+	oldReadYourWrites := *readYourWrites
+	*readYourWrites = 100 * time.Millisecond
+	defer func() {
+		*readYourWrites = oldReadYourWrites
+	}()
+	repo, _ := newLaggingReplica(t)
+	alice, err := repo.primary.GetByAccount(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := nicknameOf(t, repo, "alice"); got != "alice on replica" {
+		t.Fatalf("alice read as %q before any write, want it from the replica", got)
+	}
+	if _, _, err := repo.UpdateNickname(ctx, alice.Id, "alice updated", alice.Version); err != nil {
+		t.Fatal(err)
+	}
+	if got := nicknameOf(t, repo, "alice"); got != "alice updated" {
+		t.Fatalf("alice read as %q right after her update, want it from the primary", got)
+	}
+	if got := nicknameOf(t, repo, "bob"); got != "bob on replica" {
+		t.Fatalf("bob read as %q after alice's update, want it from the replica", got)
+	}
+	if user, err := repo.GetByAccount(readFromPrimary(ctx), "bob"); err != nil || user.Nickname != "bob on primary" {
+		t.Fatalf("bob read as %q, %v with readFromPrimary, want it from the primary", user.Nickname, err)
+	}
+
+	time.Sleep(*readYourWrites + 20*time.Millisecond)
+	if got := nicknameOf(t, repo, "alice"); got != "alice on replica" {
+		t.Fatalf("alice read as %q after -read-your-writes, want it from the replica", got)
+	}
+
+	// a conflicting write pins too, someone else just wrote the user
+	if _, _, err := repo.UpdateNickname(ctx, alice.Id, "conflict", alice.Version); err != ErrVersionConflict {
+		t.Fatalf("update at an old version: %v, want %v", err, ErrVersionConflict)
+	}
+	if got := nicknameOf(t, repo, "alice"); got != "alice updated" {
+		t.Errorf("alice read as %q after a conflict, want it from the primary", got)
+	}
+}
+
+func TestReadsSkipUnhealthyReplica(t *testing.T) {
+	repo, lagging := newLaggingReplica(t)
+	lagging.setHealthy(false, nil)
+	if got := nicknameOf(t, repo, "alice"); got != "alice on primary" {
+		t.Errorf("alice read as %q with the replica down, want it from the primary", got)
+	}
+	lagging.setHealthy(true, nil)
+	if got := nicknameOf(t, repo, "alice"); got != "alice on replica" {
+		t.Errorf("alice read as %q with the replica back up, want it from the replica", got)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+/*
+UserRepository is everything the TCP server needs from the users table, so the logic in tcp.go
+does not care whether the users live in MySQL or somewhere else.
+*/
+
+var (
+	ErrUserNotFound     = errors.New("user not found")
+	ErrDuplicateAccount = errors.New("account already exists")
+	ErrBadStatus        = errors.New("unknown account status")
+	// ErrVersionConflict means the profile was updated by someone else since expectedVersion was read
+	ErrVersionConflict = errors.New("profile was changed by another session")
+	// ErrCodeUsed means a TOTP or recovery code was accepted once already
+	ErrCodeUsed = errors.New("code was already used")
+)
+
+// account statuses, only active accounts can log in and deleted ones look like they do not exist
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+	StatusDeleted  = "deleted"
+)
+
+func validStatus(status string) bool {
+	return status == StatusActive || status == StatusDisabled || status == StatusDeleted
+}
+
+// User is a row of the users table
+type User struct {
+	Id                int
+	Account           string
+	Nickname          string
+	PasswordHash      string // sha1 of the password, see hashSHA256
+	PictureFileName   string
+	TotpSecret        string
+	TotpEnabled       bool
+	TotpRecoveryCodes string // comma separated sha1 hashes of unused recovery codes
+	TotpLastStep      int64  // time step of the last accepted TOTP code, 0 since the secret was set
+	Version           int    // bumped on every nickname or picture update
+	Status            string // StatusActive, StatusDisabled or StatusDeleted
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	LastLoginAt       time.Time // zero until the first login since it was kept
+}
+
+type UserRepository interface {
+	GetByAccount(ctx context.Context, account string) (User, error)
+	GetByID(ctx context.Context, id int) (User, error)
+	// UpdateNickname and UpdatePicture only apply when the user is still at expectedVersion,
+	// otherwise they return ErrVersionConflict. Both return the value they replaced and the version after the update.
+	UpdateNickname(ctx context.Context, id int, nickname string, expectedVersion int) (oldNickname string, version int, err error)
+	// UpdatePicture atomically swaps the file name, so the HTTP server can delete the old image without racing another upload
+	UpdatePicture(ctx context.Context, id int, fileName string, expectedVersion int) (oldFileName string, version int, err error)
+	// UpdateTotp also forgets the last accepted TOTP step, it belongs to the secret being replaced
+	UpdateTotp(ctx context.Context, id int, secret string, enabled bool, recoveryCodes string) error
+	// UseTotpStep records step as the last accepted TOTP step, returning ErrCodeUsed unless it is later than the last one
+	UseTotpStep(ctx context.Context, id int, step int64) error
+	// ReplaceRecoveryCodes swaps the unused recovery codes when they are still oldCodes, otherwise it returns ErrCodeUsed
+	ReplaceRecoveryCodes(ctx context.Context, id int, oldCodes string, newCodes string) error
+	// SetStatus changes the status of an account, returning its id and the status it replaced
+	SetStatus(ctx context.Context, account string, status string) (id int, oldStatus string, err error)
+	RecordLogin(ctx context.Context, id int, at time.Time) error
+	// Create inserts a new user and returns its id
+	Create(ctx context.Context, user User) (int, error)
+}
+
+var users UserRepository
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryUserRepository keeps users in a map, for running the logic without a database such as in tests
+type memoryUserRepository struct {
+	mu        sync.RWMutex
+	byId      map[int]*User
+	byAccount map[string]*User
+	nextId    int
+}
+
+func newMemoryUserRepository() *memoryUserRepository {
+	return &memoryUserRepository{
+		byId:      make(map[int]*User),
+		byAccount: make(map[string]*User),
+		nextId:    1,
+	}
+}
+
+func (r *memoryUserRepository) GetByAccount(ctx context.Context, account string) (User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	user, ok := r.byAccount[account]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return *user, nil
+}
+
+func (r *memoryUserRepository) GetByID(ctx context.Context, id int) (User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	user, ok := r.byId[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return *user, nil
+}
+
+// update runs change on the stored user with the write lock held
+func (r *memoryUserRepository) update(id int, change func(user *User)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.byId[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	change(user)
+	return nil
+}
+
+// updateByAccount is update for callers that only know the account
+func (r *memoryUserRepository) updateByAccount(account string, change func(user *User)) error {
+	r.mu.RLock()
+	user, ok := r.byAccount[account]
+	r.mu.RUnlock()
+	if !ok {
+		return ErrUserNotFound
+	}
+	return r.update(user.Id, change)
+}
+
+// updateProfile is update for the fields guarded by the version
+func (r *memoryUserRepository) updateProfile(id int, expectedVersion int, change func(user *User)) (version int, err error) {
+	conflict := false
+	err = r.update(id, func(user *User) {
+		if user.Version != expectedVersion {
+			conflict = true
+			return
+		}
+		change(user)
+		user.Version++
+		user.UpdatedAt = dbNow()
+		version = user.Version
+	})
+	if err == nil && conflict {
+		err = ErrVersionConflict
+	}
+	return version, err
+}
+
+func (r *memoryUserRepository) UpdateNickname(ctx context.Context, id int, nickname string, expectedVersion int) (oldNickname string, version int, err error) {
+	version, err = r.updateProfile(id, expectedVersion, func(user *User) {
+		oldNickname = user.Nickname
+		user.Nickname = nickname
+	})
+	return oldNickname, version, err
+}
+
+func (r *memoryUserRepository) UpdatePicture(ctx context.Context, id int, fileName string, expectedVersion int) (oldFileName string, version int, err error) {
+	version, err = r.updateProfile(id, expectedVersion, func(user *User) {
+		oldFileName = user.PictureFileName
+		user.PictureFileName = fileName
+	})
+	return oldFileName, version, err
+}
+
+func (r *memoryUserRepository) UpdateTotp(ctx context.Context, id int, secret string, enabled bool, recoveryCodes string) error {
+	return r.update(id, func(user *User) {
+		user.TotpSecret = secret
+		user.TotpEnabled = enabled
+		user.TotpRecoveryCodes = recoveryCodes
+		user.TotpLastStep = 0
+		user.UpdatedAt = dbNow()
+	})
+}
+
+func (r *memoryUserRepository) UseTotpStep(ctx context.Context, id int, step int64) error {
+	used := false
+	err := r.update(id, func(user *User) {
+		if step <= user.TotpLastStep {
+			used = true
+			return
+		}
+		user.TotpLastStep = step
+	})
+	if err == nil && used {
+		err = ErrCodeUsed
+	}
+	return err
+}
+
+func (r *memoryUserRepository) ReplaceRecoveryCodes(ctx context.Context, id int, oldCodes string, newCodes string) error {
+	changed := false
+	err := r.update(id, func(user *User) {
+		if user.TotpRecoveryCodes != oldCodes {
+			changed = true
+			return
+		}
+		user.TotpRecoveryCodes = newCodes
+		user.UpdatedAt = dbNow()
+	})
+	if err == nil && changed {
+		err = ErrCodeUsed
+	}
+	return err
+}
+
+func (r *memoryUserRepository) SetStatus(ctx context.Context, account string, status string) (id int, oldStatus string, err error) {
+	if !validStatus(status) {
+		return 0, "", ErrBadStatus
+	}
+	err = r.updateByAccount(account, func(user *User) {
+		id, oldStatus = user.Id, user.Status
+		user.Status = status
+		user.UpdatedAt = dbNow()
+	})
+	return id, oldStatus, err
+}
+
+func (r *memoryUserRepository) RecordLogin(ctx context.Context, id int, at time.Time) error {
+	return r.update(id, func(user *User) {
+		user.LastLoginAt = at
+	})
+}
+
+func (r *memoryUserRepository) Create(ctx context.Context, user User) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byAccount[user.Account]; ok {
+		return 0, ErrDuplicateAccount
+	}
+	user.Id = r.nextId
+	user.Version = 1
+	user.Status = StatusActive
+	user.CreatedAt = dbNow()
+	user.UpdatedAt = user.CreatedAt
+	r.nextId++
+	r.byId[user.Id] = &user
+	r.byAccount[user.Account] = &user
+	return user.Id, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+	"time"
+)
+
+// sqlUserRepository is the UserRepository backed by the users table in MySQL or SQLite.
+// Every statement is prepared once when the repository is created.
+type sqlUserRepository struct {
+	db             *sql.DB
+	getByAccount   *sql.Stmt
+	getByID        *sql.Stmt
+	selectNickname *sql.Stmt
+	updateNickname *sql.Stmt
+	selectPicture  *sql.Stmt
+	updatePicture  *sql.Stmt
+	updateTotp     *sql.Stmt
+	useTotpStep    *sql.Stmt
+	replaceCodes   *sql.Stmt
+	selectStatus   *sql.Stmt
+	updateStatus   *sql.Stmt
+	recordLogin    *sql.Stmt
+	create         *sql.Stmt
+}
+
+const selectUser = "SELECT id, account, nickname, password, pictureFileName, totpSecret, totpEnabled, totpRecoveryCodes, totpLastStep, version, status, created_at, updated_at, last_login_at FROM users"
+
+// newSQLUserRepository prepares the statements on db, driver is the -db-driver it was opened with
+func newSQLUserRepository(ctx context.Context, db *sql.DB, driver string) (*sqlUserRepository, error) {
+	r := &sqlUserRepository{db: db}
+	// lock the row being read so concurrent updates queue up behind each other,
+	// SQLite has no FOR UPDATE but only ever runs one transaction at a time anyway
+	forUpdate := ""
+	if driver == "mysql" {
+		forUpdate = " FOR UPDATE"
+	}
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&r.getByAccount, selectUser + " WHERE account=?"},
+		{&r.getByID, selectUser + " WHERE id=?"},
+		{&r.selectNickname, "SELECT nickname, version FROM users WHERE id=?" + forUpdate},
+		{&r.updateNickname, "UPDATE users SET nickname=?, version=version+1, updated_at=? WHERE id=?"},
+		{&r.selectPicture, "SELECT pictureFileName, version FROM users WHERE id=?" + forUpdate},
+		{&r.updatePicture, "UPDATE users SET pictureFileName=?, version=version+1, updated_at=? WHERE id=?"},
+		{&r.updateTotp, "UPDATE users SET totpSecret=?, totpEnabled=?, totpRecoveryCodes=?, totpLastStep=0, updated_at=? WHERE id=?"},
+		{&r.useTotpStep, "UPDATE users SET totpLastStep=? WHERE id=? AND totpLastStep<?"},
+		{&r.replaceCodes, "UPDATE users SET totpRecoveryCodes=?, updated_at=? WHERE id=? AND totpRecoveryCodes=?"},
+		{&r.selectStatus, "SELECT id, status FROM users WHERE account=?" + forUpdate},
+		{&r.updateStatus, "UPDATE users SET status=?, updated_at=? WHERE id=?"},
+		{&r.recordLogin, "UPDATE users SET last_login_at=? WHERE id=?"},
+		{&r.create, "INSERT INTO users (account, nickname, password, pictureFileName, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)"},
+	}
+	for _, s := range statements {
+		stmt, err := db.PrepareContext(ctx, s.query)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("preparing %q: %w", s.query, err)
+		}
+		*s.stmt = stmt
+	}
+	return r, nil
+}
+
+// Close releases the prepared statements, the *sql.DB is left open for its owner to close
+func (r *sqlUserRepository) Close() error {
+	for _, stmt := range []*sql.Stmt{r.getByAccount, r.getByID, r.selectNickname, r.updateNickname, r.selectPicture,
+		r.updatePicture, r.updateTotp, r.useTotpStep, r.replaceCodes, r.selectStatus, r.updateStatus, r.recordLogin, r.create} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return nil
+}
+
+// rowScanner is a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var createdAt, updatedAt, lastLoginAt dbTime
+	err := row.Scan(&user.Id, &user.Account, &user.Nickname, &user.PasswordHash, &user.PictureFileName,
+		&user.TotpSecret, &user.TotpEnabled, &user.TotpRecoveryCodes, &user.TotpLastStep, &user.Version,
+		&user.Status, &createdAt, &updatedAt, &lastLoginAt)
+	if err == sql.ErrNoRows {
+		return User{}, ErrUserNotFound
+	}
+	user.CreatedAt, user.UpdatedAt, user.LastLoginAt = createdAt.Time, updatedAt.Time, lastLoginAt.Time
+	return user, err
+}
+
+func (r *sqlUserRepository) GetByAccount(ctx context.Context, account string) (User, error) {
+	return scanUser(r.getByAccount.QueryRowContext(ctx, account))
+}
+
+func (r *sqlUserRepository) GetByID(ctx context.Context, id int) (User, error) {
+	return scanUser(r.getByID.QueryRowContext(ctx, id))
+}
+
+// expectOneRow turns an UPDATE that matched no user into ErrUserNotFound.
+// MySQL needs clientFoundRows=true in the DSN, otherwise it reports 0 rows when the value did not change.
+func expectOneRow(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrUserNotFound
+	} else if rows != 1 {
+		return fmt.Errorf("expected to affect 1 row, affected %d", rows)
+	}
+	return nil
+}
+
+func (r *sqlUserRepository) UpdateNickname(ctx context.Context, id int, nickname string, expectedVersion int) (oldNickname string, version int, err error) {
+	return r.swapProfileField(ctx, r.selectNickname, r.updateNickname, id, nickname, expectedVersion)
+}
+
+// UpdatePicture reads and replaces the file name in one transaction, so when two uploads race
+// each gets back the name the other one replaced and no file is orphaned or deleted twice
+func (r *sqlUserRepository) UpdatePicture(ctx context.Context, id int, fileName string, expectedVersion int) (oldFileName string, version int, err error) {
+	return r.swapProfileField(ctx, r.selectPicture, r.updatePicture, id, fileName, expectedVersion)
+}
+
+// swapProfileField reads the old value and version with selectStmt and writes value with updateStmt
+// in one transaction, as long as the version is still expectedVersion
+func (r *sqlUserRepository) swapProfileField(ctx context.Context, selectStmt *sql.Stmt, updateStmt *sql.Stmt, id int, value string, expectedVersion int) (oldValue string, version int, err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	// find old value first, holding the row until commit
+	err = tx.StmtContext(ctx, selectStmt).QueryRowContext(ctx, id).Scan(&oldValue, &version)
+	if err == sql.ErrNoRows {
+		return "", 0, ErrUserNotFound
+	} else if err != nil {
+		return "", 0, err
+	}
+	if version != expectedVersion {
+		return "", 0, ErrVersionConflict
+	}
+	err = expectOneRow(tx.StmtContext(ctx, updateStmt).ExecContext(ctx, value, dbNow(), id))
+	if err != nil {
+		return "", 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", 0, err
+	}
+	return oldValue, version + 1, nil
+}
+
+func (r *sqlUserRepository) UpdateTotp(ctx context.Context, id int, secret string, enabled bool, recoveryCodes string) error {
+	return expectOneRow(r.updateTotp.ExecContext(ctx, secret, enabled, recoveryCodes, dbNow(), id))
+}
+
+// UseTotpStep cannot tell a missing user from a used step, it is only called for a user that was just read
+func (r *sqlUserRepository) UseTotpStep(ctx context.Context, id int, step int64) error {
+	err := expectOneRow(r.useTotpStep.ExecContext(ctx, step, id, step))
+	if err == ErrUserNotFound {
+		return ErrCodeUsed
+	}
+	return err
+}
+
+// ReplaceRecoveryCodes cannot tell a missing user from changed codes either, the new codes always differ from oldCodes
+func (r *sqlUserRepository) ReplaceRecoveryCodes(ctx context.Context, id int, oldCodes string, newCodes string) error {
+	err := expectOneRow(r.replaceCodes.ExecContext(ctx, newCodes, dbNow(), id, oldCodes))
+	if err == ErrUserNotFound {
+		return ErrCodeUsed
+	}
+	return err
+}
+
+func (r *sqlUserRepository) SetStatus(ctx context.Context, account string, status string) (id int, oldStatus string, err error) {
+	if !validStatus(status) {
+		return 0, "", ErrBadStatus
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	err = tx.StmtContext(ctx, r.selectStatus).QueryRowContext(ctx, account).Scan(&id, &oldStatus)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrUserNotFound
+	} else if err != nil {
+		return 0, "", err
+	}
+	err = expectOneRow(tx.StmtContext(ctx, r.updateStatus).ExecContext(ctx, status, dbNow(), id))
+	if err != nil {
+		return 0, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+	return id, oldStatus, nil
+}
+
+func (r *sqlUserRepository) RecordLogin(ctx context.Context, id int, at time.Time) error {
+	return expectOneRow(r.recordLogin.ExecContext(ctx, at, id))
+}
+
+func (r *sqlUserRepository) Create(ctx context.Context, user User) (int, error) {
+	now := dbNow()
+	result, err := r.create.ExecContext(ctx, user.Account, user.Nickname, user.PasswordHash, user.PictureFileName, now, now)
+	if isDuplicateKey(err) {
+		return 0, ErrDuplicateAccount
+	} else if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// isDuplicateKey reports whether err is a unique key violation, here only possible on account
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// ER_DUP_ENTRY
+		return mysqlErr.Number == 1062
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// newSQLiteUsers migrates a new SQLite database in a temporary directory and returns its repository
+func newSQLiteUsers(t *testing.T) *sqlUserRepository {
+	t.Helper()
+	*dbDriver = "sqlite"
+	db, err := openDSN("file:" + filepath.Join(t.TempDir(), "test.db") + "?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	latest, err := latestMigration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateTo(ctx, db, latest); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := newSQLUserRepository(ctx, db, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		repo.Close()
+	})
+	return repo
+}
+
+// TestConcurrentUpdatesConflict has every session update a profile read at the same version,
+// only one of them may win and the others have to be told about the conflict
+func TestConcurrentUpdatesConflict(t *testing.T) {
+	const sessions = 20
+	repositories := []struct {
+		name string
+		new  func(t *testing.T) UserRepository
+	}{
+		{"memory", func(t *testing.T) UserRepository {
+			return newMemoryUserRepository()
+		}},
+		{"sqlite", func(t *testing.T) UserRepository {
+			return newSQLiteUsers(t)
+		}},
+	}
+	updates := []struct {
+		name   string
+		update func(repo UserRepository, id int, value string) (string, int, error)
+		read   func(user User) string
+	}{
+		{"nickname", func(repo UserRepository, id int, value string) (string, int, error) {
+			return repo.UpdateNickname(ctx, id, value, 1)
+		}, func(user User) string {
+			return user.Nickname
+		}},
+		{"picture", func(repo UserRepository, id int, value string) (string, int, error) {
+			return repo.UpdatePicture(ctx, id, value, 1)
+		}, func(user User) string {
+			return user.PictureFileName
+		}},
+	}
+	for _, repository := range repositories {
+		for _, update := range updates {
+			t.Run(repository.name+" "+update.name, func(t *testing.T) {
+				repo := repository.new(t)
+				id, err := repo.Create(ctx, User{Account: "alice", Nickname: "alice", PictureFileName: "alice.png"})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var wg sync.WaitGroup
+				errs := make([]error, sessions)
+				versions := make([]int, sessions)
+				values := make([]string, sessions)
+				for i := range errs {
+					values[i] = update.name + string(rune('a'+i))
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						_, versions[i], errs[i] = update.update(repo, id, values[i])
+					}(i)
+				}
+				wg.Wait()
+
+				winner := -1
+				for i, err := range errs {
+					if err == nil {
+						if winner != -1 {
+							t.Fatalf("sessions %d and %d both updated version 1", winner, i)
+						}
+						winner = i
+					} else if err != ErrVersionConflict {
+						t.Errorf("session %d: %v, want a conflict", i, err)
+					}
+				}
+				if winner == -1 {
+					t.Fatal("no session updated the profile")
+				}
+				if versions[winner] != 2 {
+					t.Errorf("version after the update %d, want 2", versions[winner])
+				}
+				user, err := repo.GetByID(ctx, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if update.read(user) != values[winner] || user.Version != 2 {
+					t.Errorf("stored %q at version %d, want %q of the winner at 2", update.read(user), user.Version, values[winner])
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Denylist of JWTs that were revoked before they expired.
+Single tokens are stored by their jti until the token would have expired anyway,
+revoking every session of an account stores a cut-off time in unix milliseconds, and any token issued at or before it is rejected.
+Redis is used when the cache is turned on, and every revocation is kept in memory as well, where it is all there
+is while redis is unavailable. Tokens revoked on other servers pass the check meanwhile rather than logging every
+user out, which lasts at most the lifetime of a token, and are counted as unchecked_tokens in redis_breaker.
+*/
+
+const (
+	revokedTokenPrefix   = "revoked:token:"
+	revokedAccountPrefix = "revoked:account:"
+)
+
+// memoryDenylist holds what was revoked on this server, all there is without redis or while it is unavailable
+type memoryDenylist struct {
+	mu       sync.Mutex
+	tokens   map[string]time.Time // jti -> when the entry can be dropped
+	accounts map[string]cutOff    // account -> tokens issued at or before this are revoked
+}
+
+type cutOff struct {
+	issuedBefore int64 // unix milliseconds
+	expiresAt    time.Time
+}
+
+var denylist = &memoryDenylist{
+	tokens:   make(map[string]time.Time),
+	accounts: make(map[string]cutOff),
+}
+
+func revokeToken(tokenId string, expiresAt int64) error {
+	ttl := time.Until(time.Unix(expiresAt, 0))
+	if ttl <= 0 {
+		// token is already expired so there is nothing to deny
+		return nil
+	}
+	denylist.mu.Lock()
+	denylist.tokens[tokenId] = time.Unix(expiresAt, 0)
+	denylist.mu.Unlock()
+	if useCache {
+		err := redisDB.Set(ctx, revokedTokenPrefix+tokenId, 1, ttl).Err()
+		if !redisUnavailable(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func revokeAllSessions(account string, ttlSeconds int64) error {
+	now := time.Now()
+	ttl := time.Duration(ttlSeconds) * time.Second
+	denylist.mu.Lock()
+	denylist.accounts[account] = cutOff{
+		issuedBefore: now.UnixMilli(),
+		expiresAt:    now.Add(ttl),
+	}
+	denylist.mu.Unlock()
+	if useCache {
+		err := redisDB.Set(ctx, revokedAccountPrefix+account, now.UnixMilli(), ttl).Err()
+		if !redisUnavailable(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func isTokenRevoked(tokenId string, account string, issuedAt int64) (bool, error) {
+	// revocations made on this server, whether redis was available or not, are in memory
+	if denylist.isRevoked(tokenId, account, issuedAt) {
+		return true, nil
+	}
+	if !useCache {
+		return false, nil
+	}
+	revoked, err := isTokenRevokedInRedis(tokenId, account, issuedAt)
+	if redisUnavailable(err) {
+		redisStats.Add("unchecked_tokens", 1)
+		return false, nil
+	}
+	return revoked, err
+}
+
+func isTokenRevokedInRedis(tokenId string, account string, issuedAt int64) (bool, error) {
+	revoked, err := redisDB.Exists(ctx, revokedTokenPrefix+tokenId).Result()
+	if err != nil {
+		return false, err
+	}
+	if revoked != 0 {
+		return true, nil
+	}
+	cutOffString, err := redisDB.Get(ctx, revokedAccountPrefix+account).Result()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	issuedBefore, err := strconv.ParseInt(cutOffString, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	return issuedAt <= issuedBefore, nil
+}
+
+func (d *memoryDenylist) isRevoked(tokenId string, account string, issuedAt int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if expiresAt, ok := d.tokens[tokenId]; ok {
+		if now.Before(expiresAt) {
+			return true
+		}
+		delete(d.tokens, tokenId)
+	}
+	if c, ok := d.accounts[account]; ok {
+		if now.Before(c.expiresAt) {
+			return issuedAt <= c.issuedBefore
+		}
+		delete(d.accounts, account)
+	}
+	return false
+}
+
+// purgeDenylist drops expired entries from the in-memory denylist so it does not grow forever
+func purgeDenylist() {
+	for range time.Tick(time.Minute) {
+		denylist.mu.Lock()
+		now := time.Now()
+		for tokenId, expiresAt := range denylist.tokens {
+			if now.After(expiresAt) {
+				delete(denylist.tokens, tokenId)
+			}
+		}
+		for account, c := range denylist.accounts {
+			if now.After(c.expiresAt) {
+				delete(denylist.accounts, account)
+			}
+		}
+		denylist.mu.Unlock()
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// emptyDenylist forgets what earlier tests revoked in memory
+func emptyDenylist() {
+	denylist.mu.Lock()
+	denylist.tokens = make(map[string]time.Time)
+	denylist.accounts = make(map[string]cutOff)
+	denylist.mu.Unlock()
+}
+
+// useOpenBreaker has the server cache in a redis whose breaker is open, so every command is turned away
+func useOpenBreaker(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:0"})
+	client.AddHook(&circuitBreaker{client: client, open: true})
+	oldRedis, oldUseCache := redisDB, useCache
+	redisDB, useCache = client, true
+	t.Cleanup(func() {
+		client.Close()
+		redisDB, useCache = oldRedis, oldUseCache
+	})
+}
+
+func TestTokensPassWhileBreakerOpen(t *testing.T) {
+	emptyDenylist()
+	useOpenBreaker(t)
+	now := time.Now()
+	expiresAt := now.Add(5 * time.Minute).Unix()
+	if err := revokeToken("revoked", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := revokeAllSessions("bob", 300); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		tokenId  string
+		account  string
+		issuedAt int64
+		want     bool
+	}{
+		{"valid token", "valid", "alice", now.UnixMilli(), false},
+		{"token revoked on this server", "revoked", "alice", now.UnixMilli(), true},
+		{"sessions revoked on this server", "old", "bob", now.Add(-time.Minute).UnixMilli(), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			revoked, err := isTokenRevoked(test.tokenId, test.account, test.issuedAt)
+			if err != nil || revoked != test.want {
+				t.Errorf("isTokenRevoked(%q, %q) = %v, %v, want %v", test.tokenId, test.account, revoked, err, test.want)
+			}
+		})
+	}
+}
+
+// TestRevokeAllSessionsCutOff has tokens issued around the cut-off, a login right after revoking passes even in the same second
+func TestRevokeAllSessionsCutOff(t *testing.T) {
+	emptyDenylist()
+	oldUseCache := useCache
+	useCache = false
+	defer func() {
+		useCache = oldUseCache
+	}()
+	if err := revokeAllSessions("alice", 300); err != nil {
+		t.Fatal(err)
+	}
+	issuedBefore := denylist.accounts["alice"].issuedBefore
+
+	tests := []struct {
+		name     string
+		account  string
+		issuedAt int64
+		want     bool
+	}{
+		{"a second before", "alice", issuedBefore - 1000, true},
+		{"at the cut-off", "alice", issuedBefore, true},
+		{"a millisecond after", "alice", issuedBefore + 1, false},
+		{"a second after", "alice", issuedBefore + 1000, false},
+		{"another account", "bob", issuedBefore - 1000, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			revoked, err := isTokenRevoked("token", test.account, test.issuedAt)
+			if err != nil || revoked != test.want {
+				t.Errorf("isTokenRevoked(%q, %d) = %v, %v, want %v", test.account, test.issuedAt, revoked, err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+The seed subcommand fills the users table with generated users for development and stress tests.
+Rows are inserted in batches of multi-row INSERTs that skip accounts which already exist, so running
+it again is harmless. The defaults create the accounts 0 to 199 with the password test_password
+that stress test/stresstest.lua logs in with.
+
+	go run ./app/tcp -- seed
+	go run ./app/tcp -- seed -n 100000 -account "load%06d" -picture -warm-cache
+*/
+
+const placeholderSize = 64 // pixels
+
+// seedOptions are the flags of the seed subcommand
+type seedOptions struct {
+	count     int
+	start     int
+	account   string
+	nickname  string
+	password  string
+	picture   bool
+	imagesDir string
+	batchSize int
+	warmCache bool
+}
+
+func parseSeedOptions(args []string) (seedOptions, error) {
+	var options seedOptions
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	flags.IntVar(&options.count, "n", 200, "number of users to generate")
+	flags.IntVar(&options.start, "start", 0, "number of the first user")
+	flags.StringVar(&options.account, "account", "%d", "account pattern, %d is replaced by the number of the user")
+	flags.StringVar(&options.nickname, "nickname", "user %d", "nickname pattern, %d is replaced by the number of the user")
+	flags.StringVar(&options.password, "password", "test_password", "password of every generated user")
+	flags.BoolVar(&options.picture, "picture", false, "give every new user their own generated placeholder image")
+	flags.StringVar(&options.imagesDir, "images-dir", "Images", "directory the HTTP server serves images from")
+	flags.IntVar(&options.batchSize, "batch", 500, "users per INSERT")
+	flags.BoolVar(&options.warmCache, "warm-cache", false, "also load the generated users into redis")
+	if err := flags.Parse(args); err != nil {
+		return options, err
+	}
+	if !strings.Contains(options.account, "%") {
+		return options, errors.New("-account needs a %d so every account is different")
+	}
+	if options.count < 0 || options.batchSize < 1 {
+		return options, errors.New("-n cannot be negative and -batch has to be at least 1")
+	}
+	return options, nil
+}
+
+// runSeedCommand handles the seed subcommand, args are what follows "seed"
+func runSeedCommand(ctx context.Context, db *sql.DB, args []string) error {
+	options, err := parseSeedOptions(args)
+	if err != nil {
+		return err
+	}
+	if options.warmCache {
+		if redisDB, err = newRedisClient(); err != nil {
+			return err
+		}
+		if err := redisDB.Ping(ctx).Err(); err != nil {
+			return fmt.Errorf("connecting to redis to warm the cache: %w", err)
+		}
+	}
+
+	inserted := 0
+	for first := options.start; first < options.start+options.count; first += options.batchSize {
+		last := first + options.batchSize
+		if last > options.start+options.count {
+			last = options.start + options.count
+		}
+		batch := seedBatch(options, first, last)
+		n, err := insertSeedBatch(ctx, db, batch)
+		if err != nil {
+			return err
+		}
+		inserted += n
+
+		if options.picture || options.warmCache {
+			if err := finishSeedBatch(ctx, db, options, batch); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("seeded %d new users, %d already existed\n", inserted, options.count-inserted)
+	return nil
+}
+
+// seedBatch generates the users numbered first to last-1
+func seedBatch(options seedOptions, first int, last int) []User {
+	passwordHash := hashSHA256(options.password)
+	batch := make([]User, 0, last-first)
+	for i := first; i < last; i++ {
+		user := User{
+			Account:      fmt.Sprintf(options.account, i),
+			Nickname:     fmt.Sprintf(options.nickname, i),
+			PasswordHash: passwordHash,
+		}
+		if options.picture {
+			user.PictureFileName = fmt.Sprintf("seed_%d.png", i)
+		}
+		batch = append(batch, user)
+	}
+	return batch
+}
+
+// insertSeedBatch inserts the users with one statement, returning how many did not exist yet
+func insertSeedBatch(ctx context.Context, db *sql.DB, batch []User) (int, error) {
+	insert := "INSERT IGNORE INTO"
+	if *dbDriver == "sqlite" {
+		insert = "INSERT OR IGNORE INTO"
+	}
+	now := dbNow()
+	values := make([]string, 0, len(batch))
+	args := make([]interface{}, 0, len(batch)*6)
+	for _, user := range batch {
+		values = append(values, "(?, ?, ?, ?, ?, ?)")
+		args = append(args, user.Account, user.Nickname, user.PasswordHash, user.PictureFileName, now, now)
+	}
+	query := insert + " users (account, nickname, password, pictureFileName, created_at, updated_at) VALUES " + strings.Join(values, ", ")
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
+
+// finishSeedBatch reads the batch back, drawing the placeholders of the users that got one and warming the cache.
+// Accounts that existed before keep their own picture, so no image is drawn for them.
+func finishSeedBatch(ctx context.Context, db *sql.DB, options seedOptions, batch []User) error {
+	accounts := make([]interface{}, 0, len(batch))
+	placeholders := make(map[string]bool)
+	for _, user := range batch {
+		accounts = append(accounts, user.Account)
+		if user.PictureFileName != "" {
+			placeholders[user.PictureFileName] = true
+		}
+	}
+	query := selectUser + " WHERE account IN (?" + strings.Repeat(", ?", len(accounts)-1) + ")"
+	rows, err := db.QueryContext(ctx, query, accounts...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var seeded []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+		seeded = append(seeded, user)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if options.picture {
+		for _, user := range seeded {
+			if placeholders[user.PictureFileName] {
+				if err := writePlaceholder(filepath.Join(options.imagesDir, user.PictureFileName), user.Id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if options.warmCache {
+		pipe := redisDB.Pipeline()
+		for _, user := range seeded {
+			pipeProfile(ctx, pipe, user, 0)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return fmt.Errorf("warming the cache: %w", err)
+		}
+	}
+	return nil
+}
+
+// writePlaceholder draws a square in a colour picked from seed, unless the file is already there
+func writePlaceholder(path string, seed int) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	fill := color.RGBA{R: uint8(seed * 67), G: uint8(seed * 131), B: uint8(seed * 197), A: 255}
+	img := image.NewRGBA(image.Rect(0, 0, placeholderSize, placeholderSize))
+	for x := 0; x < placeholderSize; x++ {
+		for y := 0; y < placeholderSize; y++ {
+			img.Set(x, y, fill)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
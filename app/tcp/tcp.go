@@ -10,16 +10,16 @@ import (
 	"fmt"
 	entrytaskproto "git.garena.com/wilber.chaowb/yanfeng-entry-task/protobuf_files/entry-task-proto"
 	"github.com/go-redis/redis/v8"
-	_ "github.com/go-sql-driver/mysql"
 	"google.golang.org/protobuf/proto"
+	"io"
 	"log"
+	"math"
 	"net"
-	"os"
-	"strconv"
 )
 
 var db *sql.DB // Note the sql package provides the namespace
-var redisDB *redis.Client
+var autoMigrate = flag.Bool("auto-migrate", false, "apply pending schema migrations on start up")
+var redisDB redis.UniversalClient
 var ctx = context.Background()
 var useCache bool
 
@@ -36,24 +36,39 @@ Buffer_header_meaning
 1 -> Client wants to update nickname
 2 -> Client wants to update image
 3 -> request nickname and imagePath
+4 -> revoke a single token on logout
+5 -> check if a token has been revoked
+6 -> revoke every session of an account
+7 -> begin TOTP enrollment
+8 -> confirm TOTP enrollment
+9 -> verify the TOTP code of a login
+10 -> disable TOTP
+11 -> query the audit log
+12 -> deactivate, reactivate or delete an account
 */
 func handleIncomingRequest(conn net.Conn) {
+	defer conn.Close()
 	for {
 		// Make 4 bytes on the buffer, read it, it will say for how long we need to read the input for
 		buffer := make([]byte, BufferHeaderSize)
-		_, err := conn.Read(buffer)
-
-		if err != nil {
+		_, err := io.ReadFull(conn, buffer)
+		if err == io.EOF {
+			// the HTTP server closed the connection
+			return
+		} else if err != nil {
 			log.Println("error reading buffer header from HTTP ", err)
+			return
 		}
 		messageLength := int(binary.LittleEndian.Uint32(buffer))
 
 		buffer = make([]byte, messageLength)
 
-		// read serialised information from the socket
-		_, err = conn.Read(buffer)
+		// read serialised information from the socket, a large request takes more than one read
+		_, err = io.ReadFull(conn, buffer)
 		if err != nil {
-			log.Println("error reading buffer header from HTTP ", err)
+			// the rest of the stream can no longer be told apart
+			log.Println("error reading serialised information from HTTP ", err)
+			return
 		}
 
 		request := &entrytaskproto.Req{}
@@ -66,10 +81,14 @@ func handleIncomingRequest(conn net.Conn) {
 			if err := proto.Unmarshal(request.GetPayload(), loginProtobuf); err != nil {
 				log.Fatalln("Failed to parse payload:", err)
 			}
-			successfulLogin, id := attemptLogin(loginProtobuf.GetAccount(), loginProtobuf.GetPassword())
-			if successfulLogin == 0 || successfulLogin == 1 || successfulLogin == -1 {
-				// wrong, right, or unknown
-				replyHTTPServer(conn, successfulLogin, id, "")
+			successfulLogin, id, retryAfter := attemptLogin(loginProtobuf.GetAccount(), loginProtobuf.GetPassword(), loginProtobuf.GetIp())
+			if successfulLogin == 0 || successfulLogin == 1 || successfulLogin == -1 || successfulLogin == 2 || successfulLogin == 3 || successfulLogin == 5 {
+				// wrong, right, unknown, locked out, second factor needed, or disabled
+				writeReply(conn, &entrytaskproto.Response{
+					Status:     int32(successfulLogin),
+					Id:         int32(id),
+					RetryAfter: int32(retryAfter),
+				})
 			} else {
 				// something really bad happened so crash
 				log.Fatal("Attempted login failed unexpectedly")
@@ -80,9 +99,9 @@ func handleIncomingRequest(conn net.Conn) {
 			if err := proto.Unmarshal(request.GetPayload(), updateNicknameProtobuf); err != nil {
 				log.Fatalln("Failed to parse payload:", err)
 			}
-			successful := attemptUpdateNickname(int(updateNicknameProtobuf.GetId()), updateNicknameProtobuf.GetAccount(), updateNicknameProtobuf.GetNickname())
-			if successful == 0 || successful == 1 || successful == -1 {
-				// wrong, right, or unknown
+			successful := attemptUpdateNickname(int(updateNicknameProtobuf.GetId()), updateNicknameProtobuf.GetAccount(), updateNicknameProtobuf.GetNickname(), int(updateNicknameProtobuf.GetVersion()))
+			if successful == 0 || successful == 1 || successful == 4 || successful == -1 {
+				// wrong, right, conflict, or unknown
 				replyHTTPServer(conn, successful, -1, "")
 			} else {
 				// something really bad happened so crash
@@ -96,9 +115,9 @@ func handleIncomingRequest(conn net.Conn) {
 				log.Fatalln("Failed to parse payload:", err)
 			}
 
-			successful, oldFileName := attemptUpdateFilename(int(updateFileNameProtobuf.GetId()), updateFileNameProtobuf.GetAccount(), updateFileNameProtobuf.GetFileName())
-			if successful == 0 || successful == 1 || successful == -1 {
-				// wrong, right, or unknown
+			successful, oldFileName := attemptUpdateFilename(int(updateFileNameProtobuf.GetId()), updateFileNameProtobuf.GetAccount(), updateFileNameProtobuf.GetFileName(), int(updateFileNameProtobuf.GetVersion()))
+			if successful == 0 || successful == 1 || successful == 4 || successful == -1 {
+				// wrong, right, conflict, or unknown
 				replyHTTPServer(conn, successful, -1, oldFileName)
 			} else {
 				// something really bad happened so crash
@@ -111,242 +130,292 @@ func handleIncomingRequest(conn net.Conn) {
 			if err := proto.Unmarshal(request.GetPayload(), GetNicknameAndFileNameProtobuf); err != nil {
 				log.Fatalln("Failed to parse payload:", err)
 			}
-			nickname, fileName := getNicknameAndFileName(int(GetNicknameAndFileNameProtobuf.GetId()), GetNicknameAndFileNameProtobuf.GetAccount())
-			response := &entrytaskproto.ReplyWithNicknameAndFileName{
-				Nickname:  nickname,
-				ImagePath: fileName,
+			status, user := getNicknameAndFileName(int(GetNicknameAndFileNameProtobuf.GetId()), GetNicknameAndFileNameProtobuf.GetAccount())
+			writeReply(conn, &entrytaskproto.ReplyWithNicknameAndFileName{
+				Nickname:    user.Nickname,
+				ImagePath:   user.PictureFileName,
+				TotpEnabled: user.TotpEnabled,
+				Version:     int32(user.Version),
+				Status:      int32(status),
+			})
+		} else if request.GetTypeOfMessage() == 4 {
+			// 4 for revoking a single token
+			revokeTokenProtobuf := &entrytaskproto.RevokeToken{}
+			if err := proto.Unmarshal(request.GetPayload(), revokeTokenProtobuf); err != nil {
+				log.Fatalln("Failed to parse payload:", err)
 			}
-			responseSerialised, err := proto.Marshal(response)
-			if err != nil {
-				log.Fatal("error marshalling request", err)
+			if err := revokeToken(revokeTokenProtobuf.GetTokenId(), revokeTokenProtobuf.GetExpiresAt()); err != nil {
+				log.Println("error revoking token: ", err)
+				replyHTTPServer(conn, -1, -1, "")
+			} else {
+				replyHTTPServer(conn, 1, -1, "")
 			}
-			// find length of responseSerialised
-			lengthOfResponseSerialised := len(responseSerialised)
-			// make buffer of size 4 bytes to hold an integer
-			bufferHeader := make([]byte, 4)
-			// store the integer value of the length to the buffer
-			binary.LittleEndian.PutUint32(bufferHeader, uint32(lengthOfResponseSerialised))
-			_, err = conn.Write(bufferHeader)
-			if err != nil {
-				log.Fatal("error writing buffer header from HTTP server to TCP server", err)
+		} else if request.GetTypeOfMessage() == 5 {
+			// 5 for checking a token, 1 if it is still valid and 0 if it was revoked
+			checkTokenProtobuf := &entrytaskproto.CheckToken{}
+			if err := proto.Unmarshal(request.GetPayload(), checkTokenProtobuf); err != nil {
+				log.Fatalln("Failed to parse payload:", err)
 			}
-			// write the serialised request to the TCP server
-			_, err = conn.Write(responseSerialised)
+			revoked, err := isTokenRevoked(checkTokenProtobuf.GetTokenId(), checkTokenProtobuf.GetAccount(), checkTokenProtobuf.GetIssuedAt())
 			if err != nil {
-				log.Fatal("error writing from HTTP server to TCP server", err)
+				log.Println("error checking denylist: ", err)
+				replyHTTPServer(conn, -1, -1, "")
+			} else if revoked {
+				replyHTTPServer(conn, 0, -1, "")
+			} else {
+				replyHTTPServer(conn, 1, -1, "")
 			}
-		} else {
-			log.Fatal("unrecognised message")
-		}
-	}
-}
-
-func attemptLogin(account string, password string) (successfulLogin int, id int) {
-	// Here I need to check redis
-	// If hit, then check password, and return accordingly
-	// if miss, use account to delete entry in redis, and use id to find
-	if useCache {
-		exists, err := redisDB.HExists(ctx, account, "password").Result()
-		if err != nil {
-			log.Fatal("error checking if key-value pair exists")
-		} else if exists {
-			// cache hit so find it
-			passwordFromDB, err := redisDB.HGet(ctx, account, "password").Result()
-			if err != nil {
-				log.Fatal("cache hit but password field missing: ", err)
+		} else if request.GetTypeOfMessage() == 6 {
+			// 6 for revoking every session of an account
+			revokeSessionsProtobuf := &entrytaskproto.RevokeSessions{}
+			if err := proto.Unmarshal(request.GetPayload(), revokeSessionsProtobuf); err != nil {
+				log.Fatalln("Failed to parse payload:", err)
 			}
-			// compare password
-			hashedPasswordInput := hashSHA256(password)
-			if passwordFromDB != hashedPasswordInput {
-				log.Println("wrong password")
-				// need to redirect back to login
-				return 0, -1 // 0 for false, wrong password
+			if err := revokeAllSessions(revokeSessionsProtobuf.GetAccount(), revokeSessionsProtobuf.GetTtlSeconds()); err != nil {
+				log.Println("error revoking sessions: ", err)
+				replyHTTPServer(conn, -1, -1, "")
+			} else {
+				recordAudit(AuditEvent{Account: revokeSessionsProtobuf.GetAccount(), Actor: revokeSessionsProtobuf.GetActor(), Event: AuditSessionsRevoked})
+				replyHTTPServer(conn, 1, -1, "")
 			}
-			id, err := redisDB.HGet(ctx, account, "id").Result()
-			if err != nil {
-				log.Fatal("cache hit but password field missing: ", err)
+		} else if request.GetTypeOfMessage() == 7 {
+			// 7 for beginning TOTP enrollment
+			totpEnrollProtobuf := &entrytaskproto.TotpEnroll{}
+			if err := proto.Unmarshal(request.GetPayload(), totpEnrollProtobuf); err != nil {
+				log.Fatalln("Failed to parse payload:", err)
 			}
-			idInt, err := strconv.Atoi(id)
-			if err != nil {
-				log.Fatal("error converting from string to integer: ", err)
+			status, secret, uri := beginTotpEnrollment(int(totpEnrollProtobuf.GetId()), totpEnrollProtobuf.GetAccount())
+			writeReply(conn, &entrytaskproto.TotpEnrollment{
+				Status: int32(status),
+				Secret: secret,
+				Uri:    uri,
+			})
+		} else if request.GetTypeOfMessage() == 8 {
+			// 8 for confirming TOTP enrollment with the first code
+			totpCodeProtobuf := &entrytaskproto.TotpCode{}
+			if err := proto.Unmarshal(request.GetPayload(), totpCodeProtobuf); err != nil {
+				log.Fatalln("Failed to parse payload:", err)
 			}
-			return 1, idInt // 1 for success, correct account and password
-		}
-	}
-	res, err := db.Query("SELECT id, nickname, password, pictureFileName FROM users where account=?", account)
-	if err != nil {
-		log.Fatal(err)
-		// If there is an issue with the database, return a 500 error
-		// w.WriteHeader(http.StatusInternalServerError)
-		return -1, -1 // this means that a status 500 error should be returned
-	}
-	if !res.Next() {
-		log.Println("no account found")
-		return 0, -1 // 0 for false, no such account
-	} else {
-		var id int
-		var nickname string
-		var passwordFromDB string
-		var pictureFileName string
-		err := res.Scan(&id, &nickname, &passwordFromDB, &pictureFileName)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if useCache {
-			//set up the cache for that account now
-			// Multiple field values for initializing Hash data
-			value := make(map[string]interface{})
-			value["id"] = id
-			value["nickname"] = nickname
-			value["password"] = passwordFromDB
-			value["pictureFileName"] = pictureFileName
-
-			// Save multiple Hash field values in one time
-			err = redisDB.HMSet(ctx, account, value).Err()
-			if err != nil {
-				panic(err)
+			status, recoveryCodes, retryAfter := confirmTotpEnrollment(int(totpCodeProtobuf.GetId()), totpCodeProtobuf.GetAccount(),
+				totpCodeProtobuf.GetCode(), totpCodeProtobuf.GetIp())
+			writeReply(conn, &entrytaskproto.TotpEnrollment{
+				Status:        int32(status),
+				RecoveryCodes: recoveryCodes,
+				RetryAfter:    int32(retryAfter),
+			})
+		} else if request.GetTypeOfMessage() == 9 {
+			// 9 for verifying the second step of a login
+			totpCodeProtobuf := &entrytaskproto.TotpCode{}
+			if err := proto.Unmarshal(request.GetPayload(), totpCodeProtobuf); err != nil {
+				log.Fatalln("Failed to parse payload:", err)
 			}
+			status, retryAfter := verifyTotpLogin(int(totpCodeProtobuf.GetId()), totpCodeProtobuf.GetAccount(), totpCodeProtobuf.GetCode(), totpCodeProtobuf.GetIp())
+			writeReply(conn, &entrytaskproto.Response{
+				Status:     int32(status),
+				Id:         totpCodeProtobuf.GetId(),
+				RetryAfter: int32(retryAfter),
+			})
+		} else if request.GetTypeOfMessage() == 10 {
+			// 10 for disabling TOTP, needs a valid code
+			totpCodeProtobuf := &entrytaskproto.TotpCode{}
+			if err := proto.Unmarshal(request.GetPayload(), totpCodeProtobuf); err != nil {
+				log.Fatalln("Failed to parse payload:", err)
+			}
+			status, retryAfter := disableTotp(int(totpCodeProtobuf.GetId()), totpCodeProtobuf.GetAccount(), totpCodeProtobuf.GetCode(), totpCodeProtobuf.GetIp())
+			writeReply(conn, &entrytaskproto.Response{
+				Status:     int32(status),
+				Id:         -1,
+				RetryAfter: int32(retryAfter),
+			})
+		} else if request.GetTypeOfMessage() == 11 {
+			// 11 for browsing the audit log on the admin page
+			queryAuditEventsProtobuf := &entrytaskproto.QueryAuditEvents{}
+			if err := proto.Unmarshal(request.GetPayload(), queryAuditEventsProtobuf); err != nil {
+				log.Fatalln("Failed to parse payload:", err)
+			}
+			writeReply(conn, queryAuditEvents(queryAuditEventsProtobuf))
+		} else if request.GetTypeOfMessage() == 12 {
+			// 12 for changing the status of an account from the admin page
+			setAccountStatusProtobuf := &entrytaskproto.SetAccountStatus{}
+			if err := proto.Unmarshal(request.GetPayload(), setAccountStatusProtobuf); err != nil {
+				log.Fatalln("Failed to parse payload:", err)
+			}
+			status := setAccountStatus(setAccountStatusProtobuf.GetAccount(), setAccountStatusProtobuf.GetStatus(),
+				setAccountStatusProtobuf.GetActor(), setAccountStatusProtobuf.GetTtlSeconds())
+			replyHTTPServer(conn, status, -1, "")
+		} else {
+			log.Fatal("unrecognised message")
 		}
-
-		hashedPasswordInput := hashSHA256(password)
-		if passwordFromDB != hashedPasswordInput {
-			log.Println("wrong password")
-			// need to redirect back to login
-			return 0, -1 // 0 for false, wrong password
-		}
-		return 1, id // 1 for success, correct account and password
 	}
 }
 
-func attemptUpdateNickname(id int, account string, newNickname string) (successfulLogin int) {
-	fmt.Println(id)
-	fmt.Println(account)
-	fmt.Println(newNickname)
-
-	res, err := db.Exec("UPDATE users SET nickname=? WHERE id=?", newNickname, id)
-	if err != nil {
-		log.Fatal("issue with db so execute 500 error")
-		// If there is an issue with the database, return a 500 error
-		return -1
+/*
+attemptLogin checks the password unless the account or the ip is locked out for failing too often,
+in which case it returns 2 and how many seconds to wait before trying again
+*/
+func attemptLogin(account string, password string, ip string) (successfulLogin int, id int, retryAfter int) {
+	keys := []string{accountLimitKey(account)}
+	if ip != "" {
+		keys = append(keys, ipLimitKey(ip))
 	}
-	rows, err := res.RowsAffected()
+	lockedFor, err := loginLockedFor(keys...)
 	if err != nil {
-		log.Fatal(err)
-		return 0
+		log.Println("error checking login lockout: ", err)
+		return -1, -1, 0
 	}
-	if rows != 1 {
-		log.Fatalf("expected to affect 1 row, affected %d", rows)
-		return 0
+	if lockedFor > 0 {
+		log.Println("login locked out for", account, ip)
+		recordAudit(AuditEvent{Account: account, Event: AuditLoginFailure, IP: ip, NewValue: loginFailureLockedOut})
+		return 2, -1, int(math.Ceil(lockedFor.Seconds())) // 2 for locked out
 	}
 
-	if useCache {
-		err = redisDB.HSet(ctx, account, "nickname", newNickname).Err()
-		if err != nil {
-			log.Fatal("error in setting newNickname", err)
-		}
+	// 3 means the password was right but the TOTP code still has to be checked before the failures are reset
+	successfulLogin, id, failure := checkPassword(account, password)
+	if successfulLogin == 0 {
+		recordAudit(AuditEvent{Account: account, Event: AuditLoginFailure, IP: ip, NewValue: failure})
+		err = recordLoginFailure(keys...)
+	} else if successfulLogin == 5 {
+		// the password was right, so it does not count towards a lockout
+		recordAudit(AuditEvent{Account: account, Event: AuditLoginFailure, IP: ip, NewValue: failure})
+	} else if successfulLogin == 1 {
+		recordAudit(AuditEvent{Account: account, Event: AuditLoginSuccess, IP: ip})
+		recordLogin(id)
+		err = resetLoginFailures(accountLimitKey(account))
 	}
-	return 1
+	if err != nil {
+		log.Println("error recording login attempt: ", err)
+	}
+	return successfulLogin, id, 0
 }
 
-func attemptUpdateFilename(id int, account string, newFileName string) (successfulLogin int, oldFileName string) {
-	// find old name first
-	res, err := db.Query("SELECT pictureFileName FROM users WHERE id=?", id)
+// checkPassword also returns the reason for the audit log when the login failed
+func checkPassword(account string, password string) (successfulLogin int, id int, failure string) {
+	user, ok, err := cachedCredentials(account)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("error reading cached credentials, reading the DB instead: ", err)
 	}
-	res.Next()
-	err = res.Scan(&oldFileName)
-	if err != nil {
-		log.Fatal(err)
+	if !ok {
+		fromDB, err := users.GetByAccount(ctx, account)
+		if err == ErrUserNotFound {
+			log.Println("no account found")
+			return 0, -1, loginFailureNoAccount // 0 for false, no such account
+		} else if err != nil {
+			// If there is an issue with the database, return a 500 error
+			log.Println("error reading user: ", err)
+			return -1, -1, "" // this means that a status 500 error should be returned
+		}
+		user = credentialsOf(fromDB)
+		if err := cacheCredentials(account, user); err != nil {
+			log.Println("error caching credentials: ", err)
+		}
 	}
-
-	// update nickname now
-	result, err := db.Exec("UPDATE users SET pictureFileName=? WHERE id=?", newFileName, id)
-	if err != nil {
-		log.Fatal("issue with db so execute 500 error")
-		// If there is an issue with the database, return a 500 error
-		return -1, ""
+	if user.status == StatusDeleted {
+		return 0, -1, loginFailureNoAccount // 0 for false, no such account
 	}
-	rows, err := result.RowsAffected()
-	if err != nil {
-		log.Fatal(err)
-		return 0, ""
+
+	if !user.passwordMatches(account, password) {
+		log.Println("wrong password")
+		// need to redirect back to login
+		return 0, -1, loginFailureWrongPassword // 0 for false, wrong password
 	}
-	if rows != 1 {
-		log.Fatalf("expected to affect 1 row, affected %d", rows)
-		return 0, ""
+	if user.status != StatusActive {
+		return 5, -1, loginFailureDisabled // 5 for correct password but the account is disabled
 	}
-	// write to cache new id
-	if useCache {
-		err = redisDB.HSet(ctx, account, "pictureFileName", newFileName).Err()
-		if err != nil {
-			log.Fatal("error in setting newFileName in cache", err)
-		}
+	if user.totpEnabled {
+		return 3, user.id, "" // 3 for correct password, second factor needed
 	}
-	return 1, oldFileName
+	return 1, user.id, "" // 1 for success, correct account and password
 }
 
-func getNicknameAndFileName(id int, account string) (string, string) {
-	if useCache {
-		// check if cache hit first
-		exists, error := redisDB.Exists(ctx, account).Result()
-		if error != nil {
-			log.Fatal("error reading from cache")
-		} else if exists != 0 {
-			// cache hit
-			nickname, error := redisDB.HGet(ctx, account, "nickname").Result()
-			if error != nil {
-				log.Fatal("error finding nickname", error)
-			}
-			pictureFileName, error := redisDB.HGet(ctx, account, "pictureFileName").Result()
-			if error != nil {
-				log.Fatal("error finding pictureFileName", error)
-			}
-			return nickname, pictureFileName
-		}
-	}
-
-	res, err := db.Query("SELECT nickname, password, pictureFileName FROM users where id=?", id)
+// uncacheUser drops the cached profile and credentials of the user so the next read goes to the DB,
+// used after writes the cache did not make
+func uncacheUser(id int, account string) {
+	err := profiles.Invalidate(ctx, id)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("error in deleting cached user: ", err)
 	}
-	res.Next()
-	var nickname string
-	var passwordFromDB string
-	var pictureFileName string
-	err = res.Scan(&nickname, &passwordFromDB, &pictureFileName)
+	err = uncacheCredentials(account)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("error in deleting cached credentials: ", err)
 	}
-	if useCache {
-		//set up the cache for that account now
-		// Multiple field values for initializing Hash data
-		value := make(map[string]interface{})
-		value["id"] = id
-		value["nickname"] = nickname
-		value["password"] = passwordFromDB
-		value["pictureFileName"] = pictureFileName
-
-		// Save multiple Hash field values in one time
-		err = redisDB.HMSet(ctx, account, value).Err()
-		if err != nil {
-			panic(err)
+	deleteAgain(func() error {
+		if err := profiles.Invalidate(ctx, id); err != nil {
+			return err
 		}
+		return uncacheCredentials(account)
+	})
+}
+
+/*
+status: 0 for no such user, 1 for success, 4 for conflict when the profile is no longer at version, -1 for db errors
+*/
+func attemptUpdateNickname(id int, account string, newNickname string, version int) (successfulLogin int) {
+	fmt.Println(id)
+	fmt.Println(account)
+	fmt.Println(newNickname)
+
+	oldNickname, _, err := profiles.UpdateNickname(ctx, id, newNickname, version)
+	if err == ErrUserNotFound {
+		log.Println("no user to update nickname of: ", id)
+		return 0
+	} else if err == ErrVersionConflict {
+		log.Println("nickname update lost to another session: ", id)
+		return 4
+	} else if err != nil {
+		// If there is an issue with the database, return a 500 error
+		log.Println("issue with db so execute 500 error: ", err)
+		return -1
 	}
+	recordAudit(AuditEvent{Account: account, Event: AuditNicknameChanged, OldValue: oldNickname, NewValue: newNickname})
+	return 1
+}
 
-	return nickname, pictureFileName
+// attemptUpdateFilename has the same statuses as attemptUpdateNickname
+func attemptUpdateFilename(id int, account string, newFileName string, version int) (successfulLogin int, oldFileName string) {
+	oldFileName, _, err := profiles.UpdatePicture(ctx, id, newFileName, version)
+	if err == ErrUserNotFound {
+		log.Println("no user to update picture of: ", id)
+		return 0, ""
+	} else if err == ErrVersionConflict {
+		log.Println("picture update lost to another session: ", id)
+		return 4, ""
+	} else if err != nil {
+		// If there is an issue with the database, return a 500 error
+		log.Println("issue with db so execute 500 error: ", err)
+		return -1, ""
+	}
+	recordAudit(AuditEvent{Account: account, Event: AuditPictureChanged, OldValue: oldFileName, NewValue: newFileName})
+	return 1, oldFileName
+}
+
+/*
+status: 0 for no such user, 1 for success, -1 for db errors
+*/
+func getNicknameAndFileName(id int, account string) (status int, user User) {
+	user, err := profiles.GetByID(ctx, id)
+	if err == ErrUserNotFound {
+		log.Println("no user to read the profile of: ", id)
+		return 0, User{}
+	} else if err != nil {
+		log.Println("error reading profile: ", err)
+		return -1, User{}
+	}
+	return 1, user
 }
 
 /*
 status: 0 for fail, 1 for success
 */
 func replyHTTPServer(conn net.Conn, status int, id int, oldFileName string) {
-	response := &entrytaskproto.Response{
+	writeReply(conn, &entrytaskproto.Response{
 		Status:      int32(status),
 		Id:          int32(id),
 		OldFileName: oldFileName,
-	}
+	})
+}
+
+// writeReply sends a length prefixed protobuf back to the HTTP server
+func writeReply(conn net.Conn, response proto.Message) {
 	responseSerialised, err := proto.Marshal(response)
 	if err != nil {
 		log.Fatal("error marshalling request", err)
@@ -396,20 +465,11 @@ func main() {
 	//}
 	//defer profile.Start(profile.ProfilePath(".")).Stop()
 
-	// use cache or not
-	if len(os.Args) > 1 {
-		if os.Args[2] == "y" || os.Args[2] == "yes" {
-			useCache = true
-		} else if os.Args[2] == "n" || os.Args[2] == "no" {
-			useCache = false
-		} else {
-			log.Fatal("Unknown input, please enter y/yes or n/no")
-		}
-	}
+	flag.Parse()
 
 	// connect to DB
 	var err error
-	db, err = sql.Open("mysql", "root:secret@tcp(localhost:3306)/db")
+	db, err = openDB()
 	if err != nil { // if there is an error opening the connection, handle it
 		panic(err.Error())
 	}
@@ -420,6 +480,117 @@ func main() {
 		}
 	}(db)
 
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrateCommand(ctx, db, flag.Args()[1:]); err != nil {
+			log.Fatal("error migrating: ", err)
+		}
+		return
+	}
+	if *autoMigrate {
+		latest, err := latestMigration()
+		if err == nil {
+			err = migrateTo(ctx, db, latest)
+		}
+		if err != nil {
+			log.Fatal("error migrating: ", err)
+		}
+	}
+	if flag.Arg(0) == "seed" {
+		if err := runSeedCommand(ctx, db, flag.Args()[1:]); err != nil {
+			log.Fatal("error seeding: ", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "check-cache" {
+		if err := runCheckCommand(ctx, db, flag.Args()[1:]); err != nil {
+			log.Fatal("error checking the cache: ", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "bench-cache" {
+		if err := runBenchCommand(ctx, db, flag.Args()[1:]); err != nil {
+			log.Fatal("error benchmarking the cache: ", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "drop-legacy-cache" {
+		if err := runDropLegacyCommand(ctx, db, flag.Args()[1:]); err != nil {
+			log.Fatal("error dropping legacy cached profiles: ", err)
+		}
+		return
+	}
+
+	// use cache or not
+	if flag.NArg() > 0 {
+		if flag.Arg(0) == "y" || flag.Arg(0) == "yes" {
+			useCache = true
+		} else if flag.Arg(0) == "n" || flag.Arg(0) == "no" {
+			useCache = false
+		} else {
+			log.Fatal("Unknown input, please enter y/yes or n/no")
+		}
+	}
+	// -cache picks the strategy, y and n are the old way of turning write-through on and off
+	if *cacheStrategy == "" {
+		*cacheStrategy = CacheNone
+		if useCache {
+			*cacheStrategy = CacheWriteThrough
+		}
+	}
+	useCache = *cacheStrategy != CacheNone
+
+	sqlUsers, err := newSQLUserRepository(ctx, db, *dbDriver)
+	if err != nil {
+		log.Fatal("error preparing statements: ", err)
+	}
+	defer sqlUsers.Close()
+	users = sqlUsers
+
+	sqlAudit, err := newSQLAuditLog(ctx, db)
+	if err != nil {
+		log.Fatal("error preparing audit log statements: ", err)
+	}
+	defer sqlAudit.Close()
+	auditLog = sqlAudit
+	go writeAuditEvents()
+	go writeLastLogins()
+
+	replicas, err = openReplicas()
+	if err != nil {
+		log.Fatal("error connecting to replicas: ", err)
+	}
+	defer closeReplicas(replicas)
+	if len(replicas) > 0 {
+		replicatedUsers := newReplicatedUserRepository(sqlUsers, replicas)
+		go replicatedUsers.watchReplicas()
+		users = replicatedUsers
+	}
+
+	if useCache {
+		// Implement redis here
+		redisDB, err = newRedisClient()
+		if err != nil {
+			log.Fatal("error configuring redis: ", err)
+		}
+		pong, err := redisDB.Ping(ctx).Result()
+		fmt.Println(pong, err)
+	}
+	// also where failed logins and revocations go while redis is unavailable
+	go purgeDenylist()
+	go purgeLimiter()
+	if err := loadCredentialsKey(); err != nil {
+		log.Fatal("error loading the credentials cache key: ", err)
+	}
+	if cachingCredentials() {
+		go listenForCredentialInvalidations()
+	}
+	profiles, err = newProfileCache(*cacheStrategy, redisDB, users)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("profile cache: ", *cacheStrategy)
+	go serveMetrics()
+
 	listen, err := net.Listen(TYPE, HOST+":"+PORT)
 	if err != nil {
 		log.Fatal(err)
@@ -432,17 +603,6 @@ func main() {
 		}
 	}(listen)
 
-	if useCache {
-		// Implement redis here
-		redisDB = redis.NewClient(&redis.Options{
-			Addr:     "localhost:6379",
-			Password: "",
-			DB:       0,
-		})
-		pong, err := redisDB.Ping(ctx).Result()
-		fmt.Println(pong, err)
-	}
-
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
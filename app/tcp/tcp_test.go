@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// discardAuditLog drops the events recordAudit queues, the tests check what the handlers return instead
+type discardAuditLog struct{}
+
+func (discardAuditLog) Record(ctx context.Context, event AuditEvent) error {
+	return nil
+}
+
+func (discardAuditLog) Query(ctx context.Context, query AuditQuery) ([]AuditEvent, error) {
+	return nil, nil
+}
+
+func TestMain(m *testing.M) {
+	auditLog = discardAuditLog{}
+	go writeAuditEvents()
+	os.Exit(m.Run())
+}
+
+// useMemoryUsers points the handlers at a new memory repository without any cache, and forgets failed logins
+func useMemoryUsers(t *testing.T) *memoryUserRepository {
+	t.Helper()
+	repo := newMemoryUserRepository()
+	users, profiles, useCache = repo, noProfileCache{users: repo}, false
+	limiter.mu.Lock()
+	limiter.attempts = make(map[string]*failedAttempts)
+	limiter.mu.Unlock()
+	return repo
+}
+
+// addUser creates an active account with password and returns its id
+func addUser(t *testing.T, repo *memoryUserRepository, account string, password string) int {
+	t.Helper()
+	id, err := repo.Create(ctx, User{Account: account, Nickname: account, PasswordHash: hashSHA256(password), PictureFileName: account + ".png"})
+	if err != nil {
+		t.Fatalf("creating %s: %v", account, err)
+	}
+	return id
+}
+
+func TestCheckPassword(t *testing.T) {
+	repo := useMemoryUsers(t)
+	alice := addUser(t, repo, "alice", "secret")
+	addUser(t, repo, "dan", "secret")
+	addUser(t, repo, "gone", "secret")
+	tom := addUser(t, repo, "tom", "secret")
+	if _, _, err := repo.SetStatus(ctx, "dan", StatusDisabled); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.SetStatus(ctx, "gone", StatusDeleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.UpdateTotp(ctx, tom, generateTotpSecret(), true, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		account     string
+		password    string
+		wantStatus  int
+		wantId      int
+		wantFailure string
+	}{
+		{"right password", "alice", "secret", 1, alice, ""},
+		{"wrong password", "alice", "guess", 0, -1, loginFailureWrongPassword},
+		{"no such account", "nobody", "secret", 0, -1, loginFailureNoAccount},
+		{"disabled with the right password", "dan", "secret", 5, -1, loginFailureDisabled},
+		{"disabled with a wrong password", "dan", "guess", 0, -1, loginFailureWrongPassword},
+		{"deleted", "gone", "secret", 0, -1, loginFailureNoAccount},
+		{"second factor on", "tom", "secret", 3, tom, ""},
+		{"second factor on with a wrong password", "tom", "guess", 0, -1, loginFailureWrongPassword},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, id, failure := checkPassword(test.account, test.password)
+			if status != test.wantStatus || id != test.wantId || failure != test.wantFailure {
+				t.Errorf("checkPassword(%q, %q) = %d, %d, %q, want %d, %d, %q", test.account, test.password,
+					status, id, failure, test.wantStatus, test.wantId, test.wantFailure)
+			}
+		})
+	}
+}
+
+func TestAttemptLogin(t *testing.T) {
+	type attempt struct {
+		account  string
+		password string
+		ip       string
+		want     int
+	}
+	// repeat makes n of the same attempt
+	repeat := func(n int, a attempt) []attempt {
+		attempts := make([]attempt, n)
+		for i := range attempts {
+			attempts[i] = a
+		}
+		return attempts
+	}
+	join := func(groups ...[]attempt) []attempt {
+		var attempts []attempt
+		for _, group := range groups {
+			attempts = append(attempts, group...)
+		}
+		return attempts
+	}
+	max := *maxLoginFailures
+
+	tests := []struct {
+		name     string
+		attempts []attempt
+	}{
+		{"right password", []attempt{{"alice", "secret", "1.1.1.1", 1}}},
+		{"locked out after too many failures", join(
+			repeat(max, attempt{"alice", "guess", "1.1.1.1", 0}),
+			[]attempt{{"alice", "secret", "1.1.1.1", 2}},
+		)},
+		{"locked out from another ip", join(
+			repeat(max, attempt{"alice", "guess", "1.1.1.1", 0}),
+			[]attempt{{"alice", "secret", "2.2.2.2", 2}},
+		)},
+		{"ip locked out for other accounts", join(
+			repeat(max, attempt{"alice", "guess", "1.1.1.1", 0}),
+			[]attempt{{"bob", "secret", "1.1.1.1", 2}, {"bob", "secret", "2.2.2.2", 1}},
+		)},
+		{"success forgets the failures of the account", join(
+			repeat(max-1, attempt{"alice", "guess", "1.1.1.1", 0}),
+			[]attempt{{"alice", "secret", "2.2.2.2", 1}},
+			repeat(max-1, attempt{"alice", "guess", "3.3.3.3", 0}),
+			[]attempt{{"alice", "secret", "4.4.4.4", 1}},
+		)},
+		{"disabled with the right password does not lock out", join(
+			repeat(max+1, attempt{"dan", "secret", "1.1.1.1", 5}),
+		)},
+		{"no such account counts towards the ip", join(
+			repeat(max, attempt{"nobody", "secret", "1.1.1.1", 0}),
+			[]attempt{{"alice", "secret", "1.1.1.1", 2}},
+		)},
+		{"no ip only counts towards the account", join(
+			repeat(max, attempt{"alice", "guess", "", 0}),
+			[]attempt{{"alice", "secret", "", 2}, {"bob", "secret", "", 1}},
+		)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := useMemoryUsers(t)
+			ids := map[string]int{
+				"alice": addUser(t, repo, "alice", "secret"),
+				"bob":   addUser(t, repo, "bob", "secret"),
+				"dan":   addUser(t, repo, "dan", "secret"),
+			}
+			if _, _, err := repo.SetStatus(ctx, "dan", StatusDisabled); err != nil {
+				t.Fatal(err)
+			}
+			for i, a := range test.attempts {
+				status, id, retryAfter := attemptLogin(a.account, a.password, a.ip)
+				if status != a.want {
+					t.Fatalf("attempt %d, %s from %q: status %d, want %d", i, a.account, a.ip, status, a.want)
+				}
+				if status == 1 && id != ids[a.account] {
+					t.Errorf("attempt %d: id %d, want %d", i, id, ids[a.account])
+				}
+				if status == 2 && retryAfter <= 0 {
+					t.Errorf("attempt %d: locked out without a retry after", i)
+				}
+			}
+		})
+	}
+}
+
+func TestAttemptUpdateNickname(t *testing.T) {
+	tests := []struct {
+		name         string
+		id           int // 0 for the user the test creates
+		version      int
+		wantStatus   int
+		wantNickname string
+		wantVersion  int
+	}{
+		{"current version", 0, 1, 1, "new", 2},
+		{"stale version", 0, 0, 4, "alice", 1},
+		{"no such user", 999, 1, 0, "alice", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := useMemoryUsers(t)
+			alice := addUser(t, repo, "alice", "secret")
+			id := test.id
+			if id == 0 {
+				id = alice
+			}
+			if status := attemptUpdateNickname(id, "alice", "new", test.version); status != test.wantStatus {
+				t.Errorf("status %d, want %d", status, test.wantStatus)
+			}
+			user, err := repo.GetByID(ctx, alice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Nickname != test.wantNickname || user.Version != test.wantVersion {
+				t.Errorf("nickname %q at version %d, want %q at %d", user.Nickname, user.Version, test.wantNickname, test.wantVersion)
+			}
+		})
+	}
+}
+
+func TestAttemptUpdateFilename(t *testing.T) {
+	tests := []struct {
+		name            string
+		id              int // 0 for the user the test creates
+		version         int
+		wantStatus      int
+		wantOldFileName string
+		wantFileName    string
+		wantVersion     int
+	}{
+		{"current version", 0, 1, 1, "alice.png", "new.png", 2},
+		{"stale version", 0, 2, 4, "", "alice.png", 1},
+		{"no such user", 999, 1, 0, "", "alice.png", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := useMemoryUsers(t)
+			alice := addUser(t, repo, "alice", "secret")
+			id := test.id
+			if id == 0 {
+				id = alice
+			}
+			status, oldFileName := attemptUpdateFilename(id, "alice", "new.png", test.version)
+			if status != test.wantStatus || oldFileName != test.wantOldFileName {
+				t.Errorf("attemptUpdateFilename = %d, %q, want %d, %q", status, oldFileName, test.wantStatus, test.wantOldFileName)
+			}
+			user, err := repo.GetByID(ctx, alice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.PictureFileName != test.wantFileName || user.Version != test.wantVersion {
+				t.Errorf("picture %q at version %d, want %q at %d", user.PictureFileName, user.Version, test.wantFileName, test.wantVersion)
+			}
+		})
+	}
+}
+
+func TestGetNicknameAndFileName(t *testing.T) {
+	repo := useMemoryUsers(t)
+	alice := addUser(t, repo, "alice", "secret")
+
+	status, user := getNicknameAndFileName(alice, "alice")
+	if status != 1 || user.Nickname != "alice" || user.PictureFileName != "alice.png" || user.Version != 1 {
+		t.Errorf("getNicknameAndFileName(alice) = %d, %+v", status, user)
+	}
+	if status, _ := getNicknameAndFileName(999, "nobody"); status != 0 {
+		t.Errorf("getNicknameAndFileName of no such user = %d, want 0", status)
+	}
+}
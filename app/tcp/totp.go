@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+TOTP two-factor authentication (RFC 6238) with SHA1, 6 digits and a 30 second step, which is what
+every authenticator app understands. Enrollment stores the secret first and only turns 2FA on once
+the user proves their app works by sending back a code. A code is only accepted for a time step later
+than the last accepted one, so one seen by someone else cannot be sent again. Recovery codes are stored
+as sha1 hashes and each one can only be used once.
+*/
+
+const (
+	TotpIssuer         = "entry-task"
+	TotpDigits         = 6
+	TotpStep           = 30 // seconds
+	TotpSkew           = 1  // steps either side of now that are still accepted, for clock drift
+	RecoveryCodeCount  = 8
+	recoveryCodeLength = 5 // bytes, 10 hex characters
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTotpSecret() string {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal("error generating totp secret: ", err)
+	}
+	return base32NoPadding.EncodeToString(secret)
+}
+
+// totpCode is the HOTP value (RFC 4226) for a counter
+func totpCode(secret string, counter uint64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TotpDigits, value%uint32(math.Pow10(TotpDigits))), nil
+}
+
+// matchTotpCode returns the time step code is the code of, ok is false when it is not one around now
+func matchTotpCode(secret string, code string, now time.Time) (step int64, ok bool) {
+	if len(code) != TotpDigits {
+		return 0, false
+	}
+	counter := now.Unix() / TotpStep
+	for i := -TotpSkew; i <= TotpSkew; i++ {
+		expected, err := totpCode(secret, uint64(counter+int64(i)))
+		if err != nil {
+			log.Println("error computing totp code: ", err)
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return counter + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+/*
+useTotpStep accepts the code of step unless a code of it or a later step was accepted already
+status: 0 for a used code, 1 for success, -1 for db errors
+*/
+func useTotpStep(id int, step int64) (status int) {
+	err := users.UseTotpStep(ctx, id, step)
+	if err == ErrCodeUsed {
+		log.Println("totp code used again for", id)
+		return 0
+	} else if err != nil {
+		log.Println("error recording totp step: ", err)
+		return -1
+	}
+	return 1
+}
+
+func totpURI(account string, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", TotpIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(TotpDigits))
+	values.Set("period", fmt.Sprint(TotpStep))
+	label := url.PathEscape(TotpIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// generateRecoveryCodes returns the codes to show the user and the hashes to store
+func generateRecoveryCodes() (codes []string, hashes []string) {
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatal("error generating recovery code: ", err)
+		}
+		code := hex.EncodeToString(b)
+		codes = append(codes, code)
+		hashes = append(hashes, hashSHA256(code))
+	}
+	return codes, hashes
+}
+
+// useRecoveryCode returns the stored hashes without the one matching code, and whether there was one
+func useRecoveryCode(storedHashes string, code string) (remaining string, ok bool) {
+	hashed := hashSHA256(strings.ToLower(strings.TrimSpace(code)))
+	var kept []string
+	for _, h := range strings.Split(storedHashes, ",") {
+		if h == "" {
+			continue
+		}
+		if !ok && hmac.Equal([]byte(h), []byte(hashed)) {
+			ok = true
+			continue
+		}
+		kept = append(kept, h)
+	}
+	return strings.Join(kept, ","), ok
+}
+
+/*
+beginTotpEnrollment generates a new secret for the user, 2FA stays off until it is confirmed
+status: 0 if 2FA is already on, 1 for success, -1 for db errors
+*/
+func beginTotpEnrollment(id int, account string) (status int, secret string, uri string) {
+	user, err := users.GetByID(readFromPrimary(ctx), id)
+	if err != nil {
+		log.Println("error reading totpEnabled: ", err)
+		return -1, "", ""
+	}
+	if user.TotpEnabled {
+		return 0, "", ""
+	}
+	secret = generateTotpSecret()
+	err = users.UpdateTotp(ctx, id, secret, false, "")
+	if err != nil {
+		log.Println("error saving totp secret: ", err)
+		return -1, "", ""
+	}
+	return 1, secret, totpURI(account, secret)
+}
+
+/*
+confirmTotpEnrollment turns 2FA on once the first code from the app checks out, wrong codes count towards the login lockout
+status: 0 for wrong code, 1 for success, 2 for locked out, -1 for db errors
+*/
+func confirmTotpEnrollment(id int, account string, code string, ip string) (status int, recoveryCodes []string, retryAfter int) {
+	status, retryAfter = throttleSecondFactor(account, ip, func() int {
+		status, recoveryCodes = enableTotp(id, account, code)
+		return status
+	})
+	return status, recoveryCodes, retryAfter
+}
+
+// enableTotp is confirmTotpEnrollment without the lockout
+func enableTotp(id int, account string, code string) (status int, recoveryCodes []string) {
+	user, err := users.GetByID(readFromPrimary(ctx), id)
+	if err != nil {
+		log.Println("error reading totp secret: ", err)
+		return -1, nil
+	}
+	if user.TotpEnabled || user.TotpSecret == "" {
+		return 0, nil
+	}
+	step, ok := matchTotpCode(user.TotpSecret, code, time.Now())
+	if !ok {
+		return 0, nil
+	}
+	recoveryCodes, hashes := generateRecoveryCodes()
+	err = users.UpdateTotp(ctx, id, user.TotpSecret, true, strings.Join(hashes, ","))
+	if err != nil {
+		log.Println("error enabling totp: ", err)
+		return -1, nil
+	}
+	// the code used to confirm cannot log in as well
+	useTotpStep(id, step)
+	uncacheUser(id, account)
+	recordAudit(AuditEvent{Account: account, Event: AuditTotpEnabled})
+	return 1, recoveryCodes
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code, using up the latter
+func checkSecondFactor(id int, code string) (status int) {
+	user, err := users.GetByID(readFromPrimary(ctx), id)
+	if err == ErrUserNotFound {
+		return 0
+	} else if err != nil {
+		log.Println("error reading totp secret: ", err)
+		return -1
+	}
+	if !user.TotpEnabled || user.Status != StatusActive {
+		// disabled since the password was checked
+		return 0
+	}
+	if step, ok := matchTotpCode(user.TotpSecret, strings.TrimSpace(code), time.Now()); ok {
+		return useTotpStep(id, step)
+	}
+	remaining, ok := useRecoveryCode(user.TotpRecoveryCodes, code)
+	if !ok {
+		return 0
+	}
+	// only when nobody used a code since they were read, or the same code could log in twice
+	err = users.ReplaceRecoveryCodes(ctx, id, user.TotpRecoveryCodes, remaining)
+	if err == ErrCodeUsed {
+		log.Println("recovery codes changed while using one for", id)
+		return 0
+	} else if err != nil {
+		log.Println("error using up recovery code: ", err)
+		return -1
+	}
+	log.Println("recovery code used for", id)
+	left := 0
+	if remaining != "" {
+		left = strings.Count(remaining, ",") + 1
+	}
+	recordAudit(AuditEvent{Account: user.Account, Event: AuditRecoveryCodeUsed, NewValue: fmt.Sprintf("%d left", left)})
+	return 1
+}
+
+/*
+throttleSecondFactor runs check, which checks a code sent for account from ip, unless either is locked out.
+A wrong code counts towards the same lockout as wrong passwords, so codes cannot be guessed by any way they are sent.
+status: that of check where 0 is a wrong code, or 2 for locked out
+*/
+func throttleSecondFactor(account string, ip string, check func() int) (status int, retryAfter int) {
+	keys := []string{accountLimitKey(account)}
+	if ip != "" {
+		keys = append(keys, ipLimitKey(ip))
+	}
+	lockedFor, err := loginLockedFor(keys...)
+	if err != nil {
+		log.Println("error checking login lockout: ", err)
+		return -1, 0
+	}
+	if lockedFor > 0 {
+		return 2, int(math.Ceil(lockedFor.Seconds()))
+	}
+	status = check()
+	if status == 0 {
+		if err := recordLoginFailure(keys...); err != nil {
+			log.Println("error recording login attempt: ", err)
+		}
+	}
+	return status, 0
+}
+
+/*
+verifyTotpLogin is the second step of a login
+status: 0 for wrong code, 1 for success, 2 for locked out, -1 for db errors
+*/
+func verifyTotpLogin(id int, account string, code string, ip string) (status int, retryAfter int) {
+	status, retryAfter = throttleSecondFactor(account, ip, func() int {
+		return checkSecondFactor(id, code)
+	})
+	if status == 0 {
+		recordAudit(AuditEvent{Account: account, Event: AuditLoginFailure, IP: ip, NewValue: loginFailureWrongCode})
+	} else if status == 1 {
+		recordAudit(AuditEvent{Account: account, Event: AuditLoginSuccess, IP: ip})
+		recordLogin(id)
+		if err := resetLoginFailures(accountLimitKey(account)); err != nil {
+			log.Println("error recording login attempt: ", err)
+		}
+	} else if status == 2 {
+		recordAudit(AuditEvent{Account: account, Event: AuditLoginFailure, IP: ip, NewValue: loginFailureLockedOut})
+	}
+	return status, retryAfter
+}
+
+/*
+disableTotp turns 2FA off, which needs a current code or a recovery code, wrong codes count towards the login lockout
+status: 0 for wrong code, 1 for success, 2 for locked out, -1 for db errors
+*/
+func disableTotp(id int, account string, code string, ip string) (status int, retryAfter int) {
+	status, retryAfter = throttleSecondFactor(account, ip, func() int {
+		return checkSecondFactor(id, code)
+	})
+	if status != 1 {
+		return status, retryAfter
+	}
+	err := users.UpdateTotp(ctx, id, "", false, "")
+	if err != nil {
+		log.Println("error disabling totp: ", err)
+		return -1, 0
+	}
+	uncacheUser(id, account)
+	recordAudit(AuditEvent{Account: account, Event: AuditTotpDisabled})
+	return 1, 0
+}
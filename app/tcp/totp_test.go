@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the key of the RFC 6238 test vectors, "12345678901234567890" in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTotpCode(t *testing.T) {
+	// the last 6 digits of the SHA1 vectors in RFC 6238 appendix B
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		got, err := totpCode(rfcSecret, uint64(test.unix/TotpStep))
+		if err != nil || got != test.want {
+			t.Errorf("totpCode at %d = %q, %v, want %q", test.unix, got, err, test.want)
+		}
+	}
+}
+
+func TestMatchTotpCode(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	counter := now.Unix() / TotpStep
+	codeAt := func(step int64) string {
+		code, err := totpCode(rfcSecret, uint64(step))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOk   bool
+	}{
+		{"current step", codeAt(counter), counter, true},
+		{"step before", codeAt(counter - 1), counter - 1, true},
+		{"step after", codeAt(counter + 1), counter + 1, true},
+		{"two steps before", codeAt(counter - 2), 0, false},
+		{"two steps after", codeAt(counter + 2), 0, false},
+		{"too short", codeAt(counter)[1:], 0, false},
+		{"empty", "", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := matchTotpCode(rfcSecret, test.code, now)
+			if step != test.wantStep || ok != test.wantOk {
+				t.Errorf("matchTotpCode(%q) = %d, %v, want %d, %v", test.code, step, ok, test.wantStep, test.wantOk)
+			}
+		})
+	}
+}
+
+// useTotpRepositories runs test against each repository, as the users of the server, with one account that has 2FA on
+func useTotpRepositories(t *testing.T, test func(t *testing.T, id int, recoveryCodes []string)) {
+	repositories := []struct {
+		name string
+		new  func(t *testing.T) UserRepository
+	}{
+		{"memory", func(t *testing.T) UserRepository {
+			return newMemoryUserRepository()
+		}},
+		{"sqlite", func(t *testing.T) UserRepository {
+			return newSQLiteUsers(t)
+		}},
+	}
+	for _, repository := range repositories {
+		t.Run(repository.name, func(t *testing.T) {
+			repo := repository.new(t)
+			oldUsers, oldUseCache := users, useCache
+			users, useCache = repo, false
+			t.Cleanup(func() {
+				users, useCache = oldUsers, oldUseCache
+			})
+			id, err := repo.Create(ctx, User{Account: "alice", Nickname: "alice", PasswordHash: hashSHA256("secret"), PictureFileName: "alice.png"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			codes, hashes := generateRecoveryCodes()
+			if err := repo.UpdateTotp(ctx, id, rfcSecret, true, strings.Join(hashes, ",")); err != nil {
+				t.Fatal(err)
+			}
+			test(t, id, codes)
+		})
+	}
+}
+
+// TestTotpStepsUsedOnce sends codes of the steps around now, each is accepted only when it is later than the last accepted
+func TestTotpStepsUsedOnce(t *testing.T) {
+	useTotpRepositories(t, func(t *testing.T, id int, recoveryCodes []string) {
+		counter := time.Now().Unix() / TotpStep
+		steps := []struct {
+			name string
+			step int64
+			want int
+		}{
+			{"current step", counter, 1},
+			{"current step again", counter, 0},
+			{"step before", counter - 1, 0},
+			{"step after", counter + 1, 1},
+			{"current step after a later one", counter, 0},
+		}
+		for _, step := range steps {
+			code, err := totpCode(rfcSecret, uint64(step.step))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := checkSecondFactor(id, code); status != step.want {
+				t.Fatalf("%s: checkSecondFactor = %d, want %d", step.name, status, step.want)
+			}
+		}
+	})
+}
+
+func TestRecoveryCodesUsedOnce(t *testing.T) {
+	useTotpRepositories(t, func(t *testing.T, id int, recoveryCodes []string) {
+		if status := checkSecondFactor(id, recoveryCodes[0]); status != 1 {
+			t.Fatalf("first use of a recovery code: status %d, want 1", status)
+		}
+		if status := checkSecondFactor(id, recoveryCodes[0]); status != 0 {
+			t.Fatalf("second use of a recovery code: status %d, want 0", status)
+		}
+		// typed as shown, or with the case and spaces of a copy
+		if status := checkSecondFactor(id, " "+strings.ToUpper(recoveryCodes[1])+" "); status != 1 {
+			t.Fatalf("another recovery code: status %d, want 1", status)
+		}
+		if status := checkSecondFactor(id, "0123456789"); status != 0 {
+			t.Fatalf("made up recovery code: status %d, want 0", status)
+		}
+		user, err := users.GetByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if left := strings.Count(user.TotpRecoveryCodes, ",") + 1; left != RecoveryCodeCount-2 {
+			t.Errorf("%d recovery codes left, want %d", left, RecoveryCodeCount-2)
+		}
+	})
+}
+
+// TestSecondFactorConcurrentUses sends the same code from many sessions at once, only one of them may log in
+func TestSecondFactorConcurrentUses(t *testing.T) {
+	const sessions = 20
+	useTotpRepositories(t, func(t *testing.T, id int, recoveryCodes []string) {
+		totp, err := totpCode(rfcSecret, uint64(time.Now().Unix()/TotpStep))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, code := range []string{totp, recoveryCodes[0]} {
+			var wg sync.WaitGroup
+			statuses := make(chan int, sessions)
+			for i := 0; i < sessions; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					statuses <- checkSecondFactor(id, code)
+				}()
+			}
+			wg.Wait()
+			close(statuses)
+			accepted := 0
+			for status := range statuses {
+				if status == 1 {
+					accepted++
+				} else if status != 0 {
+					t.Errorf("code %s: status %d", code, status)
+				}
+			}
+			if accepted != 1 {
+				t.Errorf("code %s accepted %d times, want once", code, accepted)
+			}
+		}
+	})
+}
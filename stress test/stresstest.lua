@@ -8,6 +8,8 @@ function setup(thread)  -- build user pool
     --end
    wrk.method = "POST"
    wrk.headers["Content-Type"] = "application/x-www-form-urlencoded"
+   -- double-submit csrf token, any value works as long as the cookie and the form field match
+   wrk.headers["Cookie"] = "csrf_token=stresstest"
    -- table.insert(threads,thread)
    -- thread:set("users",users) -- let wrk can access user pool
 end
@@ -18,7 +20,7 @@ function request()
    return wrk.format(
     "POST",
     "/login/",
-    {["Content-Type"] = "application/x-www-form-urlencoded"},
-    "account=" .. acc .. "&password=test_password"
+    {["Content-Type"] = "application/x-www-form-urlencoded", ["Cookie"] = "csrf_token=stresstest"},
+    "account=" .. acc .. "&password=test_password&csrf_token=stresstest"
    )
 end